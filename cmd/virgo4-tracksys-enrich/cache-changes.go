@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the attribute added to change messages indicating what happened to the id
+var cacheChangeAttributeName = "tracksys-change"
+var cacheChangeAdded = "added"
+var cacheChangeRemoved = "removed"
+
+// CacheChangePublisher - publishes the id's added to or removed from Tracksys so they can be re-driven through ingest
+type CacheChangePublisher struct {
+	aws   awssqs.AWS_SQS     // our SQS helper
+	queue awssqs.QueueHandle // the queue we publish to
+	limit int                // we do not publish more than this many changes from a single reload
+}
+
+// NewCacheChangePublisher - the factory, returns nil if no change queue is configured
+func NewCacheChangePublisher(config *ServiceConfig, aws awssqs.AWS_SQS) (*CacheChangePublisher, error) {
+
+	if len(config.CacheChangeQueueName) == 0 {
+		return nil, nil
+	}
+
+	queue, err := aws.QueueHandle(config.CacheChangeQueueName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CacheChangePublisher{aws: aws, queue: queue, limit: config.CacheChangeLimit}, nil
+}
+
+// Publish - publish the added and removed id's
+func (cp *CacheChangePublisher) Publish(added []string, removed []string) {
+
+	// protect against a bad response from Tracksys re-driving the entire collection
+	total := len(added) + len(removed)
+	if total > cp.limit {
+		log.Printf("WARNING: %d cache changes exceeds the limit of %d, not publishing", total, cp.limit)
+		return
+	}
+
+	messages := make([]awssqs.Message, 0, total)
+	for _, id := range added {
+		messages = append(messages, cp.makeMessage(id, cacheChangeAdded, awssqs.AttributeValueRecordOperationUpdate))
+	}
+	for _, id := range removed {
+		messages = append(messages, cp.makeMessage(id, cacheChangeRemoved, awssqs.AttributeValueRecordOperationDelete))
+	}
+
+	failed := 0
+	for start := 0; start < len(messages); start += int(awssqs.MAX_SQS_BLOCK_COUNT) {
+		end := start + int(awssqs.MAX_SQS_BLOCK_COUNT)
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		opStatus, err := cp.aws.BatchMessagePut(cp.queue, messages[start:end])
+		if err != nil {
+			if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+				log.Printf("ERROR: publishing cache changes (%s)", err)
+				failed += end - start
+				continue
+			}
+		}
+
+		for ix, op := range opStatus {
+			if op == false {
+				log.Printf("WARNING: cache change for %s failed to send to queue", messages[start+ix].Payload)
+				failed++
+			}
+		}
+	}
+
+	log.Printf("INFO: published %d cache change(s) (%d failed)", total-failed, failed)
+}
+
+func (cp *CacheChangePublisher) makeMessage(id string, change string, operation string) awssqs.Message {
+
+	attribs := awssqs.Attributes{
+		{Name: awssqs.AttributeKeyRecordId, Value: id},
+		{Name: awssqs.AttributeKeyRecordOperation, Value: operation},
+		{Name: cacheChangeAttributeName, Value: change},
+	}
+	return awssqs.Message{Attribs: attribs, Payload: []byte(id)}
+}
+
+//
+// end of file
+//
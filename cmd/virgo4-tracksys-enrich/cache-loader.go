@@ -5,15 +5,33 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"golang.org/x/sync/singleflight"
 )
 
 // CacheLoader - our interface
 type CacheLoader interface {
 	Contains(string) (bool, error)
 	Lookup(string) (*TracksysSirsiItem, error)
+	LastLoaded() time.Time
+	Suspended() bool
+	Stale() bool
 }
 
+// the available policies once a cache that cannot be reloaded has exceeded its grace period
+var cacheExpiredPolicyFatal = "fatal" // terminate the service (the historical behavior)
+var cacheExpiredPolicyPause = "pause" // stop consuming the inbound queue until the cache can be reloaded
+
+// the available policies when a PID detail lookup fails
+var pidFailurePolicyFail = "fail"       // fail the entire item lookup (the historical behavior)
+var pidFailurePolicyDegrade = "degrade" // ignore the failure, the part is not considered for OCR
+
+// how long we wait before retrying a failed reload, doubles on each failure up to the cache age
+var cacheRetryMinimum = 10 * time.Second
+
 // TracksysIdCache our singleton store
 var TracksysIdCache CacheLoader
 
@@ -24,63 +42,125 @@ type cacheLoaderImpl struct {
 	pidApi     string // the API path for requesting PID details
 	multiMode  bool   // do we expect single or m ultiple items from the endpoint
 
-	httpClient *http.Client // our http client connection
+	httpClient *http.Client  // our http client connection
+	snapshots  SnapshotStore // where we persist the cache, nil if not configured
 
-	cacheImpl   Cache         // the actual cache
+	changes *CacheChangePublisher // where we publish cache changes, nil if not configured
+
+	pidConcurrency   int    // the maximum number of concurrent PID detail lookups for an item
+	pidFailurePolicy string // what happens to the item lookup when a PID detail lookup fails
+
+	details DetailsCache       // recent lookup results, nil if not configured
+	lookups singleflight.Group // so concurrent lookups of the same item share a single request
+
+	cacheImpl   Cache         // the actual cache, replaced in its entirety on each reload
 	cacheLoaded time.Time     // when we last repopulated the cache
 	cacheMaxAge time.Duration // the maximum age of the cache
 
-	mu sync.RWMutex // coordinate cache reloads
+	gracePeriod   time.Duration // how long we continue to use the last good cache when reloads fail
+	expiredPolicy string        // what we do once the grace period expires
+	suspended     bool          // the grace period has expired and we are paused
+	stale         bool          // the cache is from a snapshot or reloads are failing
+
+	mu sync.RWMutex // protects the cache, the load time and the suspended state
 }
 
 // NewCacheLoader - the factory
-func NewCacheLoader(config *ServiceConfig) error {
+func NewCacheLoader(config *ServiceConfig, aws awssqs.AWS_SQS, store ContentCacheStore) error {
 
 	// mock implementation here if necessary
 
-	cache := NewCache()
-	impl := &cacheLoaderImpl{cacheImpl: cache}
+	if config.CacheAge <= 0 {
+		return fmt.Errorf("cache age must be greater than zero")
+	}
+
+	impl := &cacheLoaderImpl{cacheImpl: NewCache()}
 	impl.multiMode = config.Mode == "sirsi"
 	impl.loadApi = fmt.Sprintf("%s/%s", config.ServiceEndpoint, config.CacheLoadApi)
 	impl.detailsApi = fmt.Sprintf("%s/%s", config.ServiceEndpoint, config.CacheDetailsApi)
 	impl.pidApi = fmt.Sprintf("%s/%s", config.ServiceEndpoint, config.PidDetailsApi)
 	impl.cacheMaxAge = time.Duration(config.CacheAge) * time.Second
+	impl.gracePeriod = time.Duration(config.CacheGracePeriod) * time.Second
+	impl.expiredPolicy = config.CacheExpiredPolicy
+
+	// configure the http client (each worker may be making concurrent PID detail requests)
+	impl.httpClient = newHttpClient(config.Workers*config.PidDetailsConcurrency, config.ServiceTimeout)
+	snapshots, err := NewSnapshotStore(config, store)
+	if err != nil {
+		return err
+	}
+	impl.snapshots = snapshots
 
-	// configure the http client
-	impl.httpClient = newHttpClient(config.Workers, config.ServiceTimeout)
+	changes, err := NewCacheChangePublisher(config, aws)
+	if err != nil {
+		return err
+	}
+	impl.changes = changes
+	impl.details = NewDetailsCache(config)
+	impl.pidConcurrency = config.PidDetailsConcurrency
+	impl.pidFailurePolicy = config.PidDetailsFailurePolicy
 
 	// assign to our global singleton
 	TracksysIdCache = impl
 
-	// reload the cache
-	return impl.reload()
+	// if we can seed the cache from a snapshot, do the live load in the background
+	if impl.loadSnapshot() == true {
+		go impl.refresher(0)
+		return nil
+	}
+
+	// otherwise load the cache
+	err = impl.reload()
+	if err != nil {
+		return err
+	}
+
+	// and keep it fresh in the background
+	go impl.refresher(impl.cacheMaxAge)
+	return nil
 }
 
-// Contains - lookup in the cache, refresh as necessary
+// Contains - lookup in the cache, never blocks on a reload
 func (cl *cacheLoaderImpl) Contains(id string) (bool, error) {
 
-	if cl.cacheStale() == true {
+	found := cl.currentCache().Contains(id)
+	if found == true {
+		cacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		cacheLookups.WithLabelValues("miss").Inc()
+	}
+	return found, nil
+}
 
-		// lock while we refresh the cache
-		cl.mu.Lock()
-		defer cl.mu.Unlock()
+// Lookup - lookup an item... we know (or think we know) it exists so we
+// get the details from Tracksys
+func (cl *cacheLoaderImpl) Lookup(id string) (*TracksysSirsiItem, error) {
 
-		// double check pattern
-		if cl.cacheStale() == true {
-			log.Printf("INFO: cache is stale, time to reload")
-			err := cl.reload()
-			if err != nil {
-				return false, err
-			}
+	if cl.details != nil {
+		tsItem, found := cl.details.GetItem(id)
+		if found == true {
+			return tsItem, nil
+		}
+	}
+
+	// concurrent lookups for the same item share a single set of requests
+	result, err, _ := cl.lookups.Do("item:"+id, func() (interface{}, error) {
+		tsItem, err := cl.lookupItem(id)
+		if err == nil && cl.details != nil {
+			cl.details.SetItem(id, tsItem)
 		}
+		return tsItem, err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return cl.cacheImpl.Contains(id), nil
+	// the result may be shared so each caller gets their own copy
+	return copySirsiItem(result.(*TracksysSirsiItem)), nil
 }
 
-// Lookup - lookup an item... we know (or think we know) it exists so we
-// get the details from Tracksys
-func (cl *cacheLoaderImpl) Lookup(id string) (*TracksysSirsiItem, error) {
+// get the item details from Tracksys
+func (cl *cacheLoaderImpl) lookupItem(id string) (*TracksysSirsiItem, error) {
 
 	var tsItem *TracksysSirsiItem
 	var err error
@@ -92,16 +172,10 @@ func (cl *cacheLoaderImpl) Lookup(id string) (*TracksysSirsiItem, error) {
 			return nil, err
 		}
 
-		var pidItem *TracksysPidItem
-		// for each of the parts in the item
-		for ix, part := range tsItem.Items {
-			// get some PID details so we can determine if this is an OCR candidate
-			pidItem, err = cl.protocolGetPidDetails(fmt.Sprintf("%s/%s", cl.pidApi, part.Pid))
-			if err != nil {
-				return nil, err
-			}
-
-			tsItem.Items[ix].OcrCandidate = pidItem.OcrCandidate
+		// get some PID details for each of the parts so we can determine if they are OCR candidates
+		err = cl.lookupPartDetails(tsItem)
+		if err != nil {
+			return nil, err
 		}
 
 	} else {
@@ -118,26 +192,260 @@ func (cl *cacheLoaderImpl) Lookup(id string) (*TracksysSirsiItem, error) {
 	return tsItem, nil
 }
 
+// get the PID details for each part of the item, the lookups are done concurrently (up to a limit)
+// and the results applied to the corresponding part so ordering is preserved
+func (cl *cacheLoaderImpl) lookupPartDetails(tsItem *TracksysSirsiItem) error {
+
+	errs := make([]error, len(tsItem.Items))
+	limit := make(chan struct{}, cl.pidConcurrency)
+	var failed int32
+	var wg sync.WaitGroup
+
+	for ix := range tsItem.Items {
+
+		// no point in continuing if any failure fails the lookup
+		if cl.pidFailurePolicy == pidFailurePolicyFail && atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			pidItem, err := cl.lookupPid(tsItem.Items[ix].Pid)
+			if err != nil {
+				errs[ix] = err
+				atomic.StoreInt32(&failed, 1)
+				return
+			}
+			tsItem.Items[ix].OcrCandidate = pidItem.OcrCandidate
+		}(ix)
+	}
+	wg.Wait()
+
+	for ix, err := range errs {
+		if err != nil {
+			if cl.pidFailurePolicy == pidFailurePolicyFail {
+				return err
+			}
+			// degrade, the part is simply not considered an OCR candidate
+			log.Printf("WARNING: PID details for %s unavailable, ignoring (%s)", tsItem.Items[ix].Pid, err)
+		}
+	}
+
+	return nil
+}
+
+// get the PID details, from the details cache if possible
+func (cl *cacheLoaderImpl) lookupPid(pid string) (*TracksysPidItem, error) {
+
+	if cl.details != nil {
+		pidItem, found := cl.details.GetPid(pid)
+		if found == true {
+			return pidItem, nil
+		}
+	}
+
+	result, err, _ := cl.lookups.Do("pid:"+pid, func() (interface{}, error) {
+		pidItem, err := cl.protocolGetPidDetails(fmt.Sprintf("%s/%s", cl.pidApi, pid))
+		if err == nil && cl.details != nil {
+			cl.details.SetPid(pid, pidItem)
+		}
+		return pidItem, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*TracksysPidItem), nil
+}
+
+// Suspended - has the cache expired such that we should not be consuming messages
+func (cl *cacheLoaderImpl) Suspended() bool {
+
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.suspended
+}
+
+// Stale - is the cache seeded from a snapshot or the last good cache while reloads fail (or suspended), so
+// an item missing from it is not necessarily missing from Tracksys
+func (cl *cacheLoaderImpl) Stale() bool {
+
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.stale || cl.suspended
+}
+
+// reload the cache periodically, on failure we continue with the last good cache and retry with backoff
+func (cl *cacheLoaderImpl) refresher(wait time.Duration) {
+
+	var firstFailure time.Time
+
+	for {
+		time.Sleep(wait)
+		log.Printf("INFO: cache is stale, time to reload")
+		err := cl.reload()
+
+		// all is well
+		if err == nil {
+			if firstFailure.IsZero() == false {
+				log.Printf("INFO: cache reload recovered after failing since %s", firstFailure.Format(time.RFC3339))
+			}
+			firstFailure = time.Time{}
+			wait = cl.cacheMaxAge
+			cl.setSuspended(false)
+			continue
+		}
+
+		cacheReloadFailures.Inc()
+		cl.setStale(true)
+		if firstFailure.IsZero() == true {
+			firstFailure = time.Now()
+			wait = cacheRetryMinimum
+		} else {
+			wait = wait * 2
+			if wait > cl.cacheMaxAge {
+				wait = cl.cacheMaxAge
+			}
+		}
+
+		// are we still within the grace period, measured from the first failure or from when the cache was
+		// loaded (a cache seeded from a snapshot is reloaded immediately, the snapshot age is its grace)
+		failing := time.Since(firstFailure)
+		if failing <= cl.gracePeriod || time.Since(cl.LastLoaded()) <= cl.cacheMaxAge+cl.gracePeriod {
+			log.Printf("WARNING: cache reload failed (%s), using cache loaded at %s, retrying in %0.0f seconds",
+				err, cl.LastLoaded().Format(time.RFC3339), wait.Seconds())
+			continue
+		}
+
+		// after discussions with Mike, we determined that failing when attempting to reload the cache is a fatal set of
+		// circumstances and we should not continue to process items
+		if cl.expiredPolicy == cacheExpiredPolicyFatal {
+			log.Printf("ERROR: cache reload failing for %0.0f seconds, grace period expired", failing.Seconds())
+			fatalIfError(err)
+		}
+
+		log.Printf("ERROR: cache reload failing for %0.0f seconds, grace period expired, pausing queue consumption (%s)", failing.Seconds(), err)
+		cl.setSuspended(true)
+	}
+}
+
+func (cl *cacheLoaderImpl) setStale(stale bool) {
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.stale = stale
+}
+
+func (cl *cacheLoaderImpl) setSuspended(suspended bool) {
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.suspended = suspended
+	if suspended == true {
+		cacheSuspended.Set(1)
+	} else {
+		cacheSuspended.Set(0)
+	}
+}
+
 // reload the cache
 func (cl *cacheLoaderImpl) reload() error {
 
+	start := time.Now()
 	contents, err := cl.protocolGetKnownIds(cl.loadApi)
+	if err != nil {
+		return err
+	}
 
-	// after discussions with Mike, we determined that failing when attempting to reload the cache is a fatal set of
-	// circumstances and we should not continue to process items
-	fatalIfError(err)
+	// build the new cache off to the side so lookups continue against the current one
+	loaded := time.Now()
+	cl.swapCache(contents.Items, loaded)
+	cl.setStale(false)
 
-	// reload the cache
-	cl.cacheImpl.Reload(contents.Items)
-	cl.cacheLoaded = time.Now()
+	cacheReloads.Inc()
+	cacheReloadDuration.Observe(time.Since(start).Seconds())
+
+	// persist it so we can start quickly (and without Tracksys) next time
+	if cl.snapshots != nil {
+		err = cl.snapshots.Write(&CacheSnapshot{Loaded: loaded, Source: cl.loadApi, Items: contents.Items})
+		if err != nil {
+			log.Printf("WARNING: unable to write cache snapshot (%s)", err)
+		}
+	}
 
 	return nil
 }
 
-func (cl *cacheLoaderImpl) cacheStale() bool {
+// seed the cache from the snapshot if one is available
+func (cl *cacheLoaderImpl) loadSnapshot() bool {
+
+	if cl.snapshots == nil {
+		return false
+	}
+
+	snapshot, err := cl.snapshots.Read()
+	if err != nil {
+		log.Printf("WARNING: unable to read cache snapshot (%s)", err)
+		return false
+	}
+
+	log.Printf("INFO: seeding cache from snapshot of %s loaded at %s", snapshot.Source, snapshot.Loaded.Format(time.RFC3339))
+	cl.swapCache(snapshot.Items, snapshot.Loaded)
+	cl.setStale(true)
+	return true
+}
+
+// build a new cache from the supplied ids and swap it in
+func (cl *cacheLoaderImpl) swapCache(ids []string, loaded time.Time) {
+
+	fresh := NewCache()
+	fresh.Reload(ids)
+
+	cl.mu.Lock()
+	previous := cl.cacheImpl
+	cl.cacheImpl = fresh
+	cl.cacheLoaded = loaded
+	cl.mu.Unlock()
+
+	// the item details may have changed too
+	if cl.details != nil {
+		cl.details.Purge()
+	}
+
+	// report what changed since the previous generation (if there was one)
+	if previous.Size() != 0 {
+		added, removed := DiffCaches(previous, fresh)
+		log.Printf("INFO: cache reload added %d id(s) and removed %d id(s)", len(added), len(removed))
+		cacheIdsAdded.Add(float64(len(added)))
+		cacheIdsRemoved.Add(float64(len(removed)))
+
+		if cl.changes != nil && (len(added) != 0 || len(removed) != 0) {
+			cl.changes.Publish(added, removed)
+		}
+	}
+
+	cacheSize.Set(float64(fresh.Size()))
+	cacheLastLoaded.Set(float64(loaded.Unix()))
+}
+
+// the current cache
+func (cl *cacheLoaderImpl) currentCache() Cache {
+
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.cacheImpl
+}
+
+// LastLoaded - when the cache was last loaded
+func (cl *cacheLoaderImpl) LastLoaded() time.Time {
 
-	duration := time.Since(cl.cacheLoaded)
-	return duration.Seconds() > cl.cacheMaxAge.Seconds()
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.cacheLoaded
 }
 
 //
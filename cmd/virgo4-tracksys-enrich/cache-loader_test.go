@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheLoaderStale(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"items": ["u1", "u2"]}`)
+	}))
+	defer server.Close()
+
+	snapshots := &fileSnapshotStore{filename: filepath.Join(t.TempDir(), "snapshot.json")}
+	_ = snapshots.Write(&CacheSnapshot{Loaded: time.Now(), Source: server.URL, Items: []string{"u1"}})
+
+	cl := &cacheLoaderImpl{cacheImpl: NewCache(), loadApi: server.URL, httpClient: newHttpClient(1, 5), snapshots: snapshots}
+
+	// a snapshot is not current
+	if cl.loadSnapshot() == false || cl.Stale() == false {
+		t.Errorf("expected a snapshot seeded cache to be stale")
+	}
+
+	// until it is reloaded from Tracksys
+	if err := cl.reload(); err != nil || cl.Stale() == true {
+		t.Errorf("expected a reloaded cache to be current (%v)", err)
+	}
+
+	// a suspended cache is stale
+	cl.setSuspended(true)
+	if cl.Stale() == false {
+		t.Errorf("expected a suspended cache to be stale")
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// the command line argument that runs the metadata cache migration instead of the service
+var migrateCacheCommand = "migrate-cache"
+
+// the cache keys that are not metadata cache entries
+var iiifCachePrefix = "iiif/"
+
+// migrate the existing metadata cache entries to the current schema version
+func migrateCache(cfg *ServiceConfig, store ContentCacheStore, args []string) error {
+
+	flags := flag.NewFlagSet(migrateCacheCommand, flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report the entries that would be migrated without rewriting them")
+	prefix := flags.String("prefix", "", "only migrate the entries with this key prefix")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	keys, err := store.List(*prefix)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: examining %d cache entries (schema version %d, dry run %t)", len(keys), metadataCacheSchemaVersion, *dryRun)
+
+	var migrated, current, ignored, failed int
+	for _, key := range keys {
+
+		if strings.HasPrefix(key, iiifCachePrefix) == true || key == strings.TrimPrefix(cfg.CacheSnapshot, snapshotS3Prefix) {
+			ignored++
+			continue
+		}
+
+		buf, err := store.Read(key)
+		if err != nil {
+			failed++
+			continue
+		}
+
+		content, hash, version, err := migrateCacheEntry(buf)
+		if err != nil {
+			log.Printf("WARNING: %s is not a metadata cache entry, ignoring (%s)", key, err.Error())
+			ignored++
+			continue
+		}
+		if len(content) == 0 {
+			current++
+			continue
+		}
+
+		log.Printf("INFO: migrating %s from schema version %d to %d", key, version, metadataCacheSchemaVersion)
+		if *dryRun == false {
+			// the hash is the one the metadata cache step uses so the entry is not rewritten unless it changes
+			_, err = store.WriteWithHash(key, content, hash, true)
+			if err != nil {
+				failed++
+				continue
+			}
+		}
+		migrated++
+	}
+
+	log.Printf("INFO: migration complete, %d migrated, %d already current, %d ignored, %d failed", migrated, current, ignored, failed)
+	if failed != 0 {
+		return fmt.Errorf("%d cache entries could not be migrated", failed)
+	}
+	return nil
+}
+
+// migrate a single metadata cache entry, returns the migrated content (empty if the entry is already current)
+// and its hash, and the schema version of the existing entry
+func migrateCacheEntry(buf []byte) (string, string, int, error) {
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(buf, &fields)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if _, found := fields["id"]; found == false {
+		return "", "", 0, fmt.Errorf("no id")
+	}
+	if _, found := fields["withdrawn"]; found == true {
+		return "", "", 0, fmt.Errorf("withdrawn")
+	}
+
+	// entries without a schema version predate versioning
+	version := 0
+	if raw, found := fields["schema_version"]; found == true {
+		err = json.Unmarshal(raw, &version)
+		if err != nil {
+			return "", "", 0, err
+		}
+	}
+	if version >= metadataCacheSchemaVersion {
+		return "", "", version, nil
+	}
+
+	// multi PID entries have parts, single PID entries do not. The earlier schema versions are subsets of
+	// the current one so decoding into the current types is sufficient
+	var entry interface{}
+	var header *CacheEntryHeader
+	if _, found := fields["parts"]; found == true {
+		multi := &MultiPidCacheEntry{}
+		err = json.Unmarshal(buf, multi)
+		if err == nil {
+			err = multi.Validate()
+		}
+		entry, header = multi, &multi.CacheEntryHeader
+	} else {
+		single := &SinglePidCacheEntry{}
+		err = json.Unmarshal(buf, single)
+		if err == nil {
+			err = single.Validate()
+		}
+		entry, header = single, &single.CacheEntryHeader
+	}
+	if err != nil {
+		return "", "", version, err
+	}
+
+	// the generation details are left as they were, we only note the migration
+	header.SchemaVersion = metadataCacheSchemaVersion
+	header.MigratedAt = time.Now().UTC().Format(time.RFC3339)
+
+	encode := func() (string, error) { return encodeCacheEntry(entry) }
+	hash, err := stableContentHash(header, encode)
+	if err != nil {
+		return "", "", version, err
+	}
+	content, err := encode()
+	if err != nil {
+		return "", "", version, err
+	}
+	return content, hash, version, nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrateCacheEntry(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		entry    string
+		version  int
+		migrated bool
+		valid    bool
+	}{
+		{"unversioned multi", `{"id":"u1","parts":[{"pid":"uva-lib:1","label":"MSS 1"}]}`, 0, true, true},
+		{"version 1 single", `{"schema_version":1,"id":"uva-lib:1","oembed_url":"https://oembed/uva-lib:1"}`, 1, true, true},
+		{"current", `{"schema_version":2,"generated_at":"2026-01-01T00:00:00Z","id":"u1","parts":[]}`, 2, false, true},
+		{"not json", `not json`, 0, false, false},
+		{"no id", `{"parts":[]}`, 0, false, false},
+		{"tombstone", `{"schema_version":2,"id":"u1","withdrawn":true}`, 0, false, false},
+		{"invalid part", `{"id":"u1","parts":[{"label":"MSS 1"}]}`, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, hash, version, err := migrateCacheEntry([]byte(tt.entry))
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %t, got %v", tt.valid, err)
+			}
+			if err != nil {
+				return
+			}
+			if version != tt.version {
+				t.Errorf("expected version %d, got %d", tt.version, version)
+			}
+			if (len(content) != 0) != tt.migrated {
+				t.Fatalf("expected migrated %t, got %s", tt.migrated, content)
+			}
+			if tt.migrated == false {
+				return
+			}
+
+			header := CacheEntryHeader{}
+			err = json.Unmarshal([]byte(content), &header)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if header.SchemaVersion != metadataCacheSchemaVersion || len(header.MigratedAt) == 0 {
+				t.Errorf("unexpected migrated header %+v", header)
+			}
+			// we do not claim a generation we did not do
+			if len(header.GeneratedAt) != 0 || len(header.Sources) != 0 {
+				t.Errorf("unexpected generation details %+v", header)
+			}
+			if len(hash) == 0 || hash == contentHash(content) {
+				t.Errorf("expected the stable content hash")
+			}
+		})
+	}
+}
+
+// a migrated entry must have the same hash as the metadata cache step generates for the same content so it
+// is not rewritten
+func TestMigratedHashMatchesGenerated(t *testing.T) {
+
+	_, migratedHash, _, err := migrateCacheEntry([]byte(`{"id":"u1","parts":[{"pid":"uva-lib:1","label":"MSS 1","oembed_url":"https://oembed/uva-lib:1"}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mc := MetadataCache{
+		Header: NewCacheEntryHeader([]string{"https://tracksys/details/u1"}),
+		Id:     "u1",
+		Parts:  []MetadataPart{{Pid: "uva-lib:1", Label: "MSS 1", OembedUrl: "https://oembed/uva-lib:1"}},
+	}
+	_, generatedHash, err := generateContent(&mc.Header, func() (string, error) {
+		return encodeCacheEntry(NewMultiPidCacheEntry(mc))
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if migratedHash != generatedHash {
+		t.Errorf("expected the migrated and generated hashes to match")
+	}
+}
+
+//
+// end of file
+//
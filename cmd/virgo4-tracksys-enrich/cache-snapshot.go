@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// the prefix that identifies a snapshot location as a key in the digital content cache
+var snapshotS3Prefix = "s3:"
+
+// CacheSnapshot - the persisted form of the Tracksys ID cache
+type CacheSnapshot struct {
+	Loaded time.Time `json:"loaded"` // when the ids were loaded from Tracksys
+	Source string    `json:"source"` // the Tracksys URL the ids were loaded from
+	Items  []string  `json:"items"`  // the ids
+}
+
+// SnapshotStore - our interface
+type SnapshotStore interface {
+	Read() (*CacheSnapshot, error)
+	Write(*CacheSnapshot) error
+}
+
+// file based snapshot storage
+type fileSnapshotStore struct {
+	filename string
+}
+
+// digital content cache based snapshot storage
+type contentCacheSnapshotStore struct {
+	key   string
+	store ContentCacheStore
+}
+
+// NewSnapshotStore - the factory, returns nil if no snapshot location is configured
+func NewSnapshotStore(config *ServiceConfig, store ContentCacheStore) (SnapshotStore, error) {
+
+	if len(config.CacheSnapshot) == 0 {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(config.CacheSnapshot, snapshotS3Prefix) == true {
+		// anything else would not persist the snapshot in S3 (or at all for the memory store)
+		if config.ContentCacheStore != contentCacheStoreS3 {
+			return nil, fmt.Errorf("cache snapshot [%s] requires the %s content cache store", config.CacheSnapshot, contentCacheStoreS3)
+		}
+		return &contentCacheSnapshotStore{
+			key:   strings.TrimPrefix(config.CacheSnapshot, snapshotS3Prefix),
+			store: store,
+		}, nil
+	}
+
+	return &fileSnapshotStore{filename: config.CacheSnapshot}, nil
+}
+
+func (fs *fileSnapshotStore) Read() (*CacheSnapshot, error) {
+
+	buf, err := ioutil.ReadFile(fs.filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(buf)
+}
+
+func (fs *fileSnapshotStore) Write(snapshot *CacheSnapshot) error {
+
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// never leave a partial snapshot behind
+	return writeFileAtomic(fs.filename, buf)
+}
+
+func (ss *contentCacheSnapshotStore) Read() (*CacheSnapshot, error) {
+
+	buf, err := ss.store.Read(ss.key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(buf)
+}
+
+func (ss *contentCacheSnapshotStore) Write(snapshot *CacheSnapshot) error {
+
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return ss.store.Write(ss.key, string(buf))
+}
+
+func decodeSnapshot(buf []byte) (*CacheSnapshot, error) {
+
+	snapshot := CacheSnapshot{}
+	err := json.Unmarshal(buf, &snapshot)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of CacheSnapshot: %s", err)
+		return nil, err
+	}
+
+	if snapshot.Loaded.IsZero() == true || len(snapshot.Items) == 0 {
+		return nil, fmt.Errorf("cache snapshot is incomplete")
+	}
+	return &snapshot, nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewSnapshotStore(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		snapshot string
+		store    string
+		valid    bool
+	}{
+		{"none", "", contentCacheStoreMemory, true},
+		{"file", filepath.Join(t.TempDir(), "snapshot.json"), contentCacheStoreMemory, true},
+		{"s3", "s3:snapshots/ids.json", contentCacheStoreS3, true},
+		{"s3 without the s3 store", "s3:snapshots/ids.json", contentCacheStoreMemory, false},
+		{"s3 with a file store", "s3:snapshots/ids.json", contentCacheStoreFilePrefix + t.TempDir(), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.CacheSnapshot = tt.snapshot
+			config.ContentCacheStore = tt.store
+
+			// the snapshot goes through whatever store it is given, only the configuration is checked
+			store := &contentCacheStoreImpl{backend: newMemoryContentCache()}
+			snapshots, err := NewSnapshotStore(config, store)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %t, got %v", tt.valid, err)
+			}
+			if snapshots == nil {
+				if err == nil && len(tt.snapshot) != 0 {
+					t.Errorf("expected a snapshot store")
+				}
+				return
+			}
+
+			expected := &CacheSnapshot{Loaded: time.Now().UTC().Truncate(time.Second), Source: "https://tracksys/known", Items: []string{"u1", "u2"}}
+			err = snapshots.Write(expected)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got, err := snapshots.Read()
+			if err != nil || reflect.DeepEqual(got, expected) == false {
+				t.Errorf("expected %+v, got %+v (%v)", expected, got, err)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// the command line argument that runs the metadata cache sweep instead of the service
+var sweepCacheCommand = "sweep-cache"
+
+// sweep the metadata cache for entries of items that are no longer in Tracksys
+func sweepCache(cfg *ServiceConfig, store ContentCacheStore, args []string) error {
+
+	flags := flag.NewFlagSet(sweepCacheCommand, flag.ContinueOnError)
+	withdraw := flags.String("withdraw", "", "withdraw the orphaned entries (\"delete\" or \"tombstone\"), report them if not set")
+	limit := flags.Int("limit", 1000, "do not withdraw anything when there are more than this many orphaned entries")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var withdrawer CacheWithdrawer
+	if len(*withdraw) != 0 {
+		withdrawer, err = NewCacheWithdrawer(store, *withdraw)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the current set of known ids, directly from Tracksys rather than any snapshot
+	loader := &cacheLoaderImpl{httpClient: newHttpClient(1, cfg.ServiceTimeout)}
+	known, err := loader.protocolGetKnownIds(fmt.Sprintf("%s/%s", cfg.ServiceEndpoint, cfg.CacheLoadApi))
+	if err != nil {
+		return err
+	}
+	knownKeys := make(map[string]bool, len(known.Items))
+	for _, id := range known.Items {
+		knownKeys[metadataCacheKey(cfg, id)] = true
+	}
+
+	keys, err := store.List("")
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: examining %d cache entries against %d known items", len(keys), len(knownKeys))
+
+	// the IIIF manifests are withdrawn along with their metadata cache entry
+	var tombstones, withdrawn, failed int
+	orphans := make([]string, 0)
+	for _, key := range keys {
+		if strings.HasPrefix(key, iiifCachePrefix) == true || key == strings.TrimPrefix(cfg.CacheSnapshot, snapshotS3Prefix) {
+			continue
+		}
+		if knownKeys[key] == true {
+			continue
+		}
+
+		// existing tombstones are already withdrawn and do not count towards the limit
+		buf, err := store.Read(key)
+		if err != nil {
+			log.Printf("WARNING: unable to read %s (%s)", key, err.Error())
+			failed++
+			continue
+		}
+		if _, _, tombstone := withdrawnEntryDetails(key, buf); tombstone == true {
+			tombstones++
+			continue
+		}
+
+		log.Printf("INFO: %s is not a known item", key)
+		orphans = append(orphans, key)
+	}
+
+	if withdrawer == nil {
+		log.Printf("INFO: sweep complete, %d orphaned entries, %d tombstones, %d unreadable", len(orphans), tombstones, failed)
+		return nil
+	}
+
+	// protect against a bad response from Tracksys withdrawing the entire cache
+	if len(orphans) > *limit {
+		return fmt.Errorf("%d orphaned entries exceeds the limit of %d, not withdrawing", len(orphans), *limit)
+	}
+
+	for _, key := range orphans {
+		done, err := withdrawer.Withdraw(key)
+		if err != nil {
+			failed++
+			continue
+		}
+		if done == true {
+			withdrawn++
+		}
+	}
+
+	log.Printf("INFO: sweep complete, %d orphaned entries, %d tombstones, %d withdrawn, %d failed", len(orphans), tombstones, withdrawn, failed)
+	if failed != 0 {
+		return fmt.Errorf("%d cache entries could not be withdrawn", failed)
+	}
+	return nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSweepCache(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"items": ["u1"]}`)
+	}))
+	defer server.Close()
+
+	config := testConfig()
+	config.ServiceEndpoint = server.URL
+	config.CacheLoadApi = "known"
+
+	tests := []struct {
+		name       string
+		tombstones int // existing tombstones of items no longer in Tracksys
+		orphans    int // entries of items no longer in Tracksys
+		args       []string
+		valid      bool
+		remaining  int // the entries other than tombstones and the known item after the sweep
+	}{
+		{"report", 0, 2, nil, true, 2},
+		{"withdraw", 0, 2, []string{"-withdraw", "tombstone", "-limit", "2"}, true, 0},
+		{"over the limit", 0, 3, []string{"-withdraw", "delete", "-limit", "2"}, false, 3},
+		{"tombstones do not count", 5, 2, []string{"-withdraw", "delete", "-limit", "2"}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			store, err := NewContentCacheStore(config)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			_ = store.Write("u1", `{"id":"u1","parts":[]}`)
+			for ix := 0; ix < tt.tombstones; ix++ {
+				_ = store.Write(fmt.Sprintf("t%d", ix), fmt.Sprintf(`{"id":"t%d","withdrawn":true}`, ix))
+			}
+			for ix := 0; ix < tt.orphans; ix++ {
+				_ = store.Write(fmt.Sprintf("o%d", ix), fmt.Sprintf(`{"id":"o%d","parts":[]}`, ix))
+			}
+
+			err = sweepCache(config, store, tt.args)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %t, got %v", tt.valid, err)
+			}
+
+			remaining := 0
+			keys, _ := store.List("")
+			for _, key := range keys {
+				buf, _ := store.Read(key)
+				if _, _, tombstone := withdrawnEntryDetails(key, buf); tombstone == false && key != "u1" {
+					remaining++
+				}
+			}
+			if remaining != tt.remaining {
+				t.Errorf("expected %d remaining entries, got %d", tt.remaining, remaining)
+			}
+			if exists, _ := store.Exists("u1"); exists == false {
+				t.Errorf("expected the known item to remain")
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
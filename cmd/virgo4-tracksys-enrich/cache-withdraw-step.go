@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// this is our actual implementation
+type cacheWithdrawStepImpl struct {
+	config     *ServiceConfig  // the service configuration
+	withdrawer CacheWithdrawer // withdraws the metadata cache entries
+}
+
+// NewCacheWithdrawStep - the factory
+func NewCacheWithdrawStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
+
+	// mock implementation here if necessary
+
+	err := options.Validate("policy")
+	if err != nil {
+		return nil, err
+	}
+
+	impl := &cacheWithdrawStepImpl{config: config}
+	impl.withdrawer, err = NewCacheWithdrawer(store, options.Get("policy", config.CacheWithdrawnPolicy))
+	if err != nil {
+		return nil, err
+	}
+	return impl, nil
+}
+
+func (si *cacheWithdrawStepImpl) Name() string {
+	return stepNameCacheWithdraw
+}
+
+func (si *cacheWithdrawStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextRecordId}
+}
+
+func (si *cacheWithdrawStepImpl) Provides() []ContextItem {
+	return []ContextItem{}
+}
+
+func (si *cacheWithdrawStepImpl) Process(ctx *EnrichContext) (bool, error) {
+
+	// nothing we can do without an id, the extract step reports this
+	id := ctx.RecordId
+	if len(id) == 0 {
+		return true, nil
+	}
+
+	// deleted records are withdrawn regardless of Tracksys and not enriched
+	operation, _ := ctx.Message.GetAttribute(awssqs.AttributeKeyRecordOperation)
+	if operation == awssqs.AttributeValueRecordOperationDelete {
+		log.Printf("INFO: id %s is deleted, withdrawing any cache entry", id)
+		_, err := si.withdrawer.Withdraw(metadataCacheKey(si.config, id))
+		if err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	// the item is not in the cache yet but may be in Tracksys
+	_, ignoreCache := ctx.Message.GetAttribute(ignoreCacheAttributeName)
+	if ignoreCache == true {
+		return true, nil
+	}
+
+	// a snapshot or the last good cache while reloads fail may be missing items that are in Tracksys, so we
+	// only withdraw against a current cache
+	if TracksysIdCache.Stale() == true {
+		return true, nil
+	}
+
+	// items in Tracksys continue through the pipeline
+	found, err := TracksysIdCache.Contains(id)
+	if err != nil {
+		return false, err
+	}
+	if found == true {
+		return true, nil
+	}
+
+	withdrawn, err := si.withdrawer.Withdraw(metadataCacheKey(si.config, id))
+	if err != nil {
+		return false, err
+	}
+
+	// and the document should no longer refer to it
+	if withdrawn == true {
+		log.Printf("INFO: id %s is no longer in tracksys, withdrew its cache entry", id)
+		ctx.RemoveField(metadataCacheFieldName)
+		ctx.RemoveField(iiifManifestUrlFieldName)
+	}
+	return true, nil
+}
+
+//
+// end of file
+//
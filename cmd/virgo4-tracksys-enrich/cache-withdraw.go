@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// the available policies for the metadata cache entries of items that are no longer in Tracksys
+var cacheWithdrawnPolicyKeep = "keep"           // leave the entry in place (the historical behavior)
+var cacheWithdrawnPolicyDelete = "delete"       // delete the entry (and any cached IIIF manifests)
+var cacheWithdrawnPolicyTombstone = "tombstone" // replace the entry with a tombstone (and delete any cached IIIF manifests)
+
+// WithdrawnCacheEntry - the tombstone that replaces the metadata cache entry of a withdrawn item
+type WithdrawnCacheEntry struct {
+	CacheEntryHeader
+	Id        string `json:"id"`
+	Withdrawn bool   `json:"withdrawn"`
+}
+
+// CacheWithdrawer - our interface
+type CacheWithdrawer interface {
+
+	// withdraw the metadata cache entry with the specified key, returns true if there was an entry to withdraw
+	Withdraw(string) (bool, error)
+}
+
+// this is our actual implementation
+type cacheWithdrawerImpl struct {
+	policy string            // delete or tombstone
+	store  ContentCacheStore // the digital content cache
+}
+
+// NewCacheWithdrawer - the factory
+func NewCacheWithdrawer(store ContentCacheStore, policy string) (CacheWithdrawer, error) {
+
+	if policy != cacheWithdrawnPolicyDelete && policy != cacheWithdrawnPolicyTombstone {
+		return nil, fmt.Errorf("unsupported cache withdrawn policy [%s]", policy)
+	}
+	return &cacheWithdrawerImpl{policy: policy, store: store}, nil
+}
+
+func (cw *cacheWithdrawerImpl) Withdraw(key string) (bool, error) {
+
+	exists, err := cw.store.Exists(key)
+	if err != nil || exists == false {
+		return false, err
+	}
+
+	buf, err := cw.store.Read(key)
+	if err != nil {
+		return false, err
+	}
+
+	id, pids, withdrawn := withdrawnEntryDetails(key, buf)
+	if withdrawn == true {
+		// already a tombstone, nothing to do
+		return false, nil
+	}
+
+	// the cached IIIF manifests are only reachable through the entry so they go regardless of the policy
+	for _, pid := range pids {
+		manifestKey := fmt.Sprintf("%s%s.json", iiifCachePrefix, normalizeId(pid))
+		exists, err = cw.store.Exists(manifestKey)
+		if err != nil {
+			return false, err
+		}
+		if exists == true {
+			err = cw.store.Delete(manifestKey)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if cw.policy == cacheWithdrawnPolicyTombstone {
+		content, err := encodeCacheEntry(&WithdrawnCacheEntry{CacheEntryHeader: NewCacheEntryHeader(nil), Id: id, Withdrawn: true})
+		if err != nil {
+			return false, err
+		}
+		err = cw.store.Write(key, content)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		err = cw.store.Delete(key)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	cacheWithdrawals.WithLabelValues(cw.policy).Inc()
+	log.Printf("INFO: withdrew cache entry %s (%s, %d manifest(s))", key, cw.policy, len(pids))
+	return true, nil
+}
+
+// the id and PIDs of an existing metadata cache entry and whether it is already a tombstone. Entries we
+// cannot decode are withdrawn using the key as the id
+func withdrawnEntryDetails(key string, buf []byte) (string, []string, bool) {
+
+	entry := struct {
+		Id        string              `json:"id"`
+		Withdrawn bool                `json:"withdrawn"`
+		Parts     []MultiPidCachePart `json:"parts"`
+	}{}
+	err := json.Unmarshal(buf, &entry)
+	if err != nil || len(entry.Id) == 0 {
+		log.Printf("WARNING: %s is not a metadata cache entry, withdrawing anyway", key)
+		return key, nil, false
+	}
+
+	// single PID entries are identified by their PID
+	pids := []string{entry.Id}
+	if entry.Parts != nil {
+		pids = make([]string, 0, len(entry.Parts))
+		for _, p := range entry.Parts {
+			pids = append(pids, p.Pid)
+		}
+	}
+	return entry.Id, pids, entry.Withdrawn
+}
+
+// the metadata cache key for an item id, Sirsi items use the catalog key and other items the normalized PID
+func metadataCacheKey(config *ServiceConfig, id string) string {
+	if config.Mode == "sirsi" {
+		return id
+	}
+	return normalizeId(id)
+}
+
+//
+// end of file
+//
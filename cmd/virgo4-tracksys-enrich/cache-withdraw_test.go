@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestWithdrawnEntryDetails(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		entry     string
+		id        string
+		pids      []string
+		withdrawn bool
+	}{
+		{"multi pid", `{"id":"u1","parts":[{"pid":"uva-lib:1"},{"pid":"uva-lib:2"}]}`, "u1", []string{"uva-lib:1", "uva-lib:2"}, false},
+		{"no parts", `{"id":"u1","parts":[]}`, "u1", []string{}, false},
+		{"single pid", `{"id":"uva-lib:1","oembed_url":"https://oembed/uva-lib:1"}`, "uva-lib:1", []string{"uva-lib:1"}, false},
+		{"tombstone", `{"schema_version":2,"id":"u1","withdrawn":true}`, "u1", []string{"u1"}, true},
+		{"no id", `{"parts":[]}`, "key", nil, false},
+		{"not json", `<html/>`, "key", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, pids, withdrawn := withdrawnEntryDetails("key", []byte(tt.entry))
+			if id != tt.id || reflect.DeepEqual(pids, tt.pids) == false || withdrawn != tt.withdrawn {
+				t.Errorf("expected %s %v %t, got %s %v %t", tt.id, tt.pids, tt.withdrawn, id, pids, withdrawn)
+			}
+		})
+	}
+}
+
+func TestMetadataCacheKey(t *testing.T) {
+
+	tests := []struct {
+		mode     string
+		id       string
+		expected string
+	}{
+		{"sirsi", "u1", "u1"},
+		{"sirsi", "u:1", "u:1"},
+		{"tracksys", "uva-lib:1", "uva-lib-1"},
+	}
+
+	for _, tt := range tests {
+		if got := metadataCacheKey(&ServiceConfig{Mode: tt.mode}, tt.id); got != tt.expected {
+			t.Errorf("%s %s: expected %s, got %s", tt.mode, tt.id, tt.expected, got)
+		}
+	}
+}
+
+func TestCacheWithdraw(t *testing.T) {
+
+	entry := `{"id":"u1","parts":[{"pid":"uva-lib:1"},{"pid":"uva-lib:2"}]}`
+	tests := []struct {
+		name      string
+		policy    string
+		entry     string
+		withdrawn bool
+		remaining []string
+	}{
+		{"delete", cacheWithdrawnPolicyDelete, entry, true, []string{"other", "iiif/uva-lib-3.json"}},
+		{"tombstone", cacheWithdrawnPolicyTombstone, entry, true, []string{"u1", "other", "iiif/uva-lib-3.json"}},
+		{"already a tombstone", cacheWithdrawnPolicyTombstone, `{"id":"u1","withdrawn":true}`, false, []string{"u1", "iiif/uva-lib-1.json", "iiif/uva-lib-2.json"}},
+		{"missing", cacheWithdrawnPolicyDelete, "", false, []string{"iiif/uva-lib-1.json"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &contentCacheStoreImpl{backend: newMemoryContentCache()}
+			if len(tt.entry) != 0 {
+				_ = store.Write("u1", tt.entry)
+			}
+			for _, key := range []string{"other", "iiif/uva-lib-1.json", "iiif/uva-lib-2.json", "iiif/uva-lib-3.json"} {
+				_ = store.Write(key, "{}")
+			}
+
+			withdrawer := &cacheWithdrawerImpl{policy: tt.policy, store: store}
+			withdrawn, err := withdrawer.Withdraw("u1")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if withdrawn != tt.withdrawn {
+				t.Errorf("expected withdrawn %t, got %t", tt.withdrawn, withdrawn)
+			}
+
+			for _, key := range tt.remaining {
+				if exists, _ := store.Exists(key); exists == false {
+					t.Errorf("expected %s to remain", key)
+				}
+			}
+			if tt.withdrawn == true && tt.policy == cacheWithdrawnPolicyTombstone {
+				buf, _ := store.Read("u1")
+				if _, _, tombstone := withdrawnEntryDetails("u1", buf); tombstone == false {
+					t.Errorf("expected a tombstone, got %s", string(buf))
+				}
+			}
+			if tt.withdrawn == true {
+				for _, key := range []string{"iiif/uva-lib-1.json", "iiif/uva-lib-2.json"} {
+					if exists, _ := store.Exists(key); exists == true {
+						t.Errorf("expected %s to be withdrawn", key)
+					}
+				}
+			}
+		})
+	}
+}
+
+// a Tracksys id cache with fixed contents
+type testIdCache struct {
+	ids       map[string]bool
+	stale     bool
+	suspended bool
+}
+
+func (tc *testIdCache) Contains(id string) (bool, error) { return tc.ids[id], nil }
+func (tc *testIdCache) Lookup(id string) (*TracksysSirsiItem, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (tc *testIdCache) LastLoaded() time.Time { return time.Now() }
+func (tc *testIdCache) Suspended() bool       { return tc.suspended }
+func (tc *testIdCache) Stale() bool           { return tc.stale || tc.suspended }
+
+func TestCacheWithdrawStep(t *testing.T) {
+
+	deleted := awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationDelete}
+	ignoreCache := awssqs.Attribute{Name: ignoreCacheAttributeName, Value: "true"}
+	tests := []struct {
+		name      string
+		cache     testIdCache
+		attribs   awssqs.Attributes
+		proceed   bool
+		withdrawn bool
+	}{
+		{"in tracksys", testIdCache{ids: map[string]bool{"u1": true}}, nil, true, false},
+		{"no longer in tracksys", testIdCache{}, nil, true, true},
+		{"stale cache", testIdCache{stale: true}, nil, true, false},
+		{"suspended cache", testIdCache{suspended: true}, nil, true, false},
+		{"ignoring the cache", testIdCache{}, awssqs.Attributes{ignoreCache}, true, false},
+		{"deleted", testIdCache{ids: map[string]bool{"u1": true}}, awssqs.Attributes{deleted}, false, true},
+		{"deleted ignoring the cache", testIdCache{stale: true}, awssqs.Attributes{ignoreCache, deleted}, false, true},
+	}
+
+	saved := TracksysIdCache
+	defer func() { TracksysIdCache = saved }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := tt.cache
+			TracksysIdCache = &cache
+
+			store := &contentCacheStoreImpl{backend: newMemoryContentCache()}
+			_ = store.Write("u1", `{"id":"u1","parts":[]}`)
+			step := &cacheWithdrawStepImpl{config: testConfig(), withdrawer: &cacheWithdrawerImpl{policy: cacheWithdrawnPolicyDelete, store: store}}
+
+			payload := `<add><doc><field name="id">u1</field>` +
+				`<field name="` + metadataCacheFieldName + `">https://cache/bucket/u1</field>` +
+				`<field name="` + iiifManifestUrlFieldName + `">https://iiif/u1</field></doc></add>`
+			message := testMessage("u1", payload)
+			message.Attribs = append(message.Attribs, tt.attribs...)
+			ctx := NewEnrichContext("sirsi", message)
+
+			proceed, err := step.Process(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if proceed != tt.proceed {
+				t.Errorf("expected proceed %t, got %t", tt.proceed, proceed)
+			}
+			exists, _ := store.Exists("u1")
+			if exists == tt.withdrawn {
+				t.Errorf("expected withdrawn %t, entry exists %t", tt.withdrawn, exists)
+			}
+
+			// a withdrawn entry is no longer referenced by the document it continues through the pipeline
+			for _, field := range []string{metadataCacheFieldName, iiifManifestUrlFieldName} {
+				values, _ := ctx.Field(field)
+				if (len(values) == 0) != (tt.withdrawn == true && tt.proceed == true) {
+					t.Errorf("%s: unexpected values %v", field, values)
+				}
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
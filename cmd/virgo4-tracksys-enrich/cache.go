@@ -11,6 +11,8 @@ import (
 type Cache interface {
 	Reload([]string)
 	Contains(string) bool
+	Size() int
+	Ids() []string
 }
 
 // our implementation
@@ -57,6 +59,42 @@ func (ci *cacheImpl) Contains(id string) bool {
 	return found
 }
 
+// the number of id's in the cache
+func (ci *cacheImpl) Size() int {
+	return ci.c.ItemCount()
+}
+
+// the id's in the cache
+func (ci *cacheImpl) Ids() []string {
+
+	items := ci.c.Items()
+	ids := make([]string, 0, len(items))
+	for k := range items {
+		ids = append(ids, k)
+	}
+	return ids
+}
+
+// DiffCaches - the id's added and removed between the previous and current caches
+func DiffCaches(previous Cache, current Cache) ([]string, []string) {
+
+	added := make([]string, 0)
+	for _, id := range current.Ids() {
+		if previous.Contains(id) == false {
+			added = append(added, id)
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, id := range previous.Ids() {
+		if current.Contains(id) == false {
+			removed = append(removed, id)
+		}
+	}
+
+	return added, removed
+}
+
 //
 // end of file
 //
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCacheReload(t *testing.T) {
+
+	c := NewCache()
+	c.Reload([]string{"u1", "", "u2", "u1"})
+
+	if c.Size() != 2 {
+		t.Fatalf("expected 2 ids, got %d", c.Size())
+	}
+	if c.Contains("u1") == false || c.Contains("u2") == false || c.Contains("") == true {
+		t.Fatalf("unexpected cache contents %v", c.Ids())
+	}
+}
+
+func TestDiffCaches(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		previous []string
+		current  []string
+		added    []string
+		removed  []string
+	}{
+		{"unchanged", []string{"u1", "u2"}, []string{"u2", "u1"}, []string{}, []string{}},
+		{"added", []string{"u1"}, []string{"u1", "u2", "u3"}, []string{"u2", "u3"}, []string{}},
+		{"removed", []string{"u1", "u2", "u3"}, []string{"u2"}, []string{}, []string{"u1", "u3"}},
+		{"both", []string{"u1", "u2"}, []string{"u2", "u3"}, []string{"u3"}, []string{"u1"}},
+		{"emptied", []string{"u1"}, []string{}, []string{}, []string{"u1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := NewCache()
+			previous.Reload(tt.previous)
+			current := NewCache()
+			current.Reload(tt.current)
+
+			added, removed := DiffCaches(previous, current)
+			sort.Strings(added)
+			sort.Strings(removed)
+			if reflect.DeepEqual(added, tt.added) == false {
+				t.Errorf("added: expected %v, got %v", tt.added, added)
+			}
+			if reflect.DeepEqual(removed, tt.removed) == false {
+				t.Errorf("removed: expected %v, got %v", tt.removed, removed)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
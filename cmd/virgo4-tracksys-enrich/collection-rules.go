@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
+)
+
+// the metadata cache features a collection rule can suppress
+var cacheFeaturePdf = "pdf"
+var cacheFeatureOcr = "ocr"
+
+// CollectionRules - the collection specific enrichment rules
+type CollectionRules struct {
+	Collections []CollectionRule `json:"collections"`
+}
+
+// CollectionRule - the enrichment rules for a single digital collection
+type CollectionRule struct {
+	Collection    string              `json:"collection"`               // the Tracksys collection name
+	Fields        []FieldMappingEntry `json:"fields,omitempty"`         // additional fields for items in the collection
+	Overrides     []FieldMappingEntry `json:"overrides,omitempty"`      // replace the mapped values of these fields
+	Suppress      []string            `json:"suppress,omitempty"`       // remove these mapped fields
+	CacheSuppress []string            `json:"cache_suppress,omitempty"` // metadata cache features to omit ("pdf", "ocr")
+}
+
+// the collection rules are shared by all the steps (and workers) so they cannot diverge
+var sharedCollectionRules *CollectionRules
+var sharedCollectionRulesErr error
+var sharedCollectionRulesOnce sync.Once
+
+// NewCollectionRules - the factory, the configured rules file is only loaded once
+func NewCollectionRules(config *ServiceConfig) (*CollectionRules, error) {
+
+	sharedCollectionRulesOnce.Do(func() {
+		sharedCollectionRules, sharedCollectionRulesErr = LoadCollectionRules(config.CollectionRulesFile)
+	})
+	return sharedCollectionRules, sharedCollectionRulesErr
+}
+
+// LoadCollectionRules - load and validate the collection rules file, no file means no rules
+func LoadCollectionRules(filename string) (*CollectionRules, error) {
+
+	rules := CollectionRules{}
+	if len(filename) == 0 {
+		return &rules, nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(buf, &rules)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of CollectionRules: %s", err)
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for ix, rule := range rules.Collections {
+		err = rule.validate()
+		if err == nil && seen[rule.Collection] == true {
+			err = fmt.Errorf("duplicate collection")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: collection rule %d (%s): %s", filename, ix, rule.Collection, err)
+		}
+		seen[rule.Collection] = true
+	}
+
+	log.Printf("INFO: loaded %d collection rules from %s", len(rules.Collections), filename)
+	return &rules, nil
+}
+
+func (rule CollectionRule) validate() error {
+
+	if len(rule.Collection) == 0 {
+		return fmt.Errorf("no collection name")
+	}
+	for _, entry := range append(rule.Fields, rule.Overrides...) {
+		err := entry.validate()
+		if err != nil {
+			return fmt.Errorf("field %s: %s", entry.Name, err)
+		}
+	}
+	for _, feature := range rule.CacheSuppress {
+		if feature != cacheFeaturePdf && feature != cacheFeatureOcr {
+			return fmt.Errorf("unknown cache feature [%s]", feature)
+		}
+	}
+	return nil
+}
+
+// Lookup - the rule for the specified collection, nil if there is none
+func (cr *CollectionRules) Lookup(collection string) *CollectionRule {
+	if len(collection) == 0 {
+		return nil
+	}
+	for ix := range cr.Collections {
+		if cr.Collections[ix].Collection == collection {
+			return &cr.Collections[ix]
+		}
+	}
+	return nil
+}
+
+// ApplyFields - apply the suppressions, overrides and additional fields for the item collection to the
+// mapped fields
+func (cr *CollectionRules) ApplyFields(fields []solrdoc.Field, item *TracksysSirsiItem, computed map[string][]string) []solrdoc.Field {
+
+	rule := cr.Lookup(item.Collection)
+	if rule == nil {
+		return fields
+	}
+
+	doc := solrdoc.NewDocument()
+	doc.AppendFields(fields...)
+
+	for _, name := range rule.Suppress {
+		doc.Remove(name)
+	}
+
+	for _, entry := range rule.Overrides {
+		values, applies := entry.evaluate(item, computed)
+		if applies == true {
+			if len(values) == 0 {
+				doc.Remove(entry.Name)
+			} else {
+				doc.Set(entry.Name, values...)
+			}
+		}
+	}
+
+	appendMappedFields(doc, rule.Fields, item, computed)
+	return doc.Fields
+}
+
+// CacheSuppressed - is the metadata cache feature suppressed for the item collection
+func (cr *CollectionRules) CacheSuppressed(item *TracksysSirsiItem, feature string) bool {
+
+	rule := cr.Lookup(item.Collection)
+	if rule == nil {
+		return false
+	}
+	for _, f := range rule.CacheSuppress {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// end of file
+//
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
+)
+
+func TestLoadDefaultCollectionRules(t *testing.T) {
+	_, err := LoadCollectionRules(testMappingsDir + "/collection-rules.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestCollectionRulesValidate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		rule  CollectionRule
+		valid bool
+	}{
+		{"fields", CollectionRule{Collection: "c", Fields: []FieldMappingEntry{{Name: "f", Source: "part.barcode"}}}, true},
+		{"no collection", CollectionRule{Suppress: []string{"f"}}, false},
+		{"invalid field", CollectionRule{Collection: "c", Overrides: []FieldMappingEntry{{Name: "f"}}}, false},
+		{"unknown cache feature", CollectionRule{Collection: "c", CacheSuppress: []string{"thumbnail"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestCollectionRulesApplyFields(t *testing.T) {
+
+	rules := &CollectionRules{Collections: []CollectionRule{{
+		Collection:    "Gannon",
+		Fields:        []FieldMappingEntry{{Name: "barcode_a", Source: "part.barcode"}},
+		Overrides:     []FieldMappingEntry{{Name: "format_f", Values: []string{"Manuscript"}}, {Name: "pdf_url_a", Source: "pdfServiceRoot"}},
+		Suppress:      []string{"thumbnail_url_a"},
+		CacheSuppress: []string{cacheFeaturePdf},
+	}}}
+
+	fields := []solrdoc.Field{
+		{Name: "format_f", Value: "Online"},
+		{Name: "thumbnail_url_a", Value: "t"},
+		{Name: "pdf_url_a", Value: "p"},
+		{Name: "id_a", Value: "u1"},
+	}
+
+	tests := []struct {
+		name       string
+		collection string
+		expected   []solrdoc.Field
+	}{
+		{"no rule", "Other", fields},
+		{"rule", "Gannon", []solrdoc.Field{
+			{Name: "format_f", Value: "Manuscript"},
+			{Name: "id_a", Value: "u1"},
+			{Name: "barcode_a", Value: "X001"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := testItem()
+			item.Collection = tt.collection
+			input := append([]solrdoc.Field(nil), fields...)
+			result := rules.ApplyFields(input, item, map[string][]string{})
+			if reflect.DeepEqual(result, tt.expected) == false {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+
+	item := testItem()
+	item.Collection = "Gannon"
+	if rules.CacheSuppressed(item, cacheFeaturePdf) == false || rules.CacheSuppressed(item, cacheFeatureOcr) == true {
+		t.Errorf("unexpected cache suppression")
+	}
+}
+
+//
+// end of file
+//
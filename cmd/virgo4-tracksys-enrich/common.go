@@ -1,78 +1,37 @@
 package main
 
 import (
-	"bytes"
-	"encoding/xml"
-	"fmt"
-	"regexp"
-	"strings"
-)
-
-var ErrorTypeAssertion = fmt.Errorf("failure to type assert interface")
-
-// AppendXmlField construct a tag pair and append it on to the end of the document
-func AppendXmlField(message string, fieldName string, fieldValue string) string {
-
-	docEndTag := "</doc>"
-	var additional strings.Builder
-	additional.WriteString(ConstructFieldTagPair(fieldName, fieldValue))
-	additional.WriteString(docEndTag)
-	replaced := strings.Replace(message, docEndTag, additional.String(), 1)
-	return replaced
-}
+	"log"
 
-// RemoveXmlField remove the specified field from the document
-func RemoveXmlField(message string, fieldName string) string {
-
-	matchExpr := fmt.Sprintf("<field name=\"%s\">.*?</field>", fieldName)
-	re := regexp.MustCompile(matchExpr)
-	return re.ReplaceAllString(message, "")
-}
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
+)
 
-// ExtractXmlFields extract multiple field values from the document
-func ExtractXmlFields(message string, fieldName string) []string {
+// ParsePayload parse the message payload into a Solr add document
+func ParsePayload(message *awssqs.Message) (*solrdoc.AddDoc, error) {
 
-	matchExpr := fmt.Sprintf("<field name=\"%s\">(.*?)</field>", fieldName)
-	re := regexp.MustCompile(matchExpr)
-	rs := re.FindAllStringSubmatch(message, -1)
-	// no match
-	if rs == nil {
-		return []string{}
-	}
-	// return the matches
-	var res []string
-	for _, m := range rs {
-		if len(m[1]) != 0 {
-			res = append(res, m[1])
-		}
+	add, err := solrdoc.Parse(message.Payload)
+	if err != nil {
+		log.Printf("ERROR: unable to parse message payload (%s)", err)
+		return nil, err
 	}
-	return res
+	return add, nil
 }
 
-func XmlEncodeValues(values []string) []string {
-	for ix := range values {
-		values[ix] = xmlEscape(values[ix])
-	}
-
-	return values
+// UpdatePayload replace the message payload with the serialized document
+func UpdatePayload(message *awssqs.Message, add *solrdoc.AddDoc) {
+	message.Payload = add.Bytes()
 }
 
-func ConstructFieldTagSet(name string, values []string) string {
-	var res strings.Builder
+// nonEmpty return the supplied values with any empty ones removed
+func nonEmpty(values []string) []string {
+	res := make([]string, 0, len(values))
 	for _, v := range values {
-		res.WriteString(ConstructFieldTagPair(name, v))
+		if len(v) != 0 {
+			res = append(res, v)
+		}
 	}
-	return res.String()
-}
-
-func ConstructFieldTagPair(name string, value string) string {
-	return fmt.Sprintf("<field name=\"%s\">%s</field>", name, value)
-}
-
-func xmlEscape(value string) string {
-	var escaped bytes.Buffer
-	_ = xml.EscapeText(&escaped, []byte(value))
-	return escaped.String()
+	return res
 }
 
 //
@@ -15,6 +15,9 @@ type ServiceConfig struct {
 	PollTimeOut       int64  // the SQS queue timeout (in seconds)
 	MessageBucketName string // the bucket to use for large messages
 
+	DeadLetterQueueName string // SQS queue name for documents that fail enrichment (optional)
+	DeadLetterPolicy    string // what to do with failed documents: "forward", "deadletter" or "both"
+
 	ServiceEndpoint string // the URL of the tracksys endpoint
 	ServiceTimeout  int    // service timeout (in seconds)
 
@@ -22,19 +25,53 @@ type ServiceConfig struct {
 	CacheDetailsApi string // the API path used to get the cache details
 	CacheAge        int    // how frequently do we reload the cache (in seconds)
 
+	CacheGracePeriod   int    // how long we use the last good cache when reloads fail (in seconds)
+	CacheExpiredPolicy string // what to do once the grace period expires: "fatal" or "pause"
+	CacheSnapshot      string // where to persist the cache: a local filename or "s3:<key>" in the cache bucket with the s3 content cache store (optional)
+
+	CacheChangeQueueName string // SQS queue name to publish id's added or removed by a cache reload (optional)
+	CacheChangeLimit     int    // do not publish when a single reload changes more than this many id's
+
+	DetailsCacheSize int // the maximum number of lookup results we cache, 0 to disable
+	DetailsCacheTTL  int // how long we cache lookup results (in seconds)
+
 	PidDetailsApi  string // the API path used to get the OCR eligible info
 	OcrServiceRoot string // the root link for the OCR service (for eligible items)
 
-	RewriteFields map[string]string // the fields we explicitly rewrite
+	PidDetailsConcurrency   int    // the maximum number of concurrent PID detail lookups for a single item
+	PidDetailsFailurePolicy string // what to do when a PID detail lookup fails: "fail" or "degrade"
+
+	RewriteRulesFile string // the field rewrite rules file
+
+	PipelineFile        string // the pipeline definition file, the default pipeline for the mode is used if not set
+	CollectionRulesFile string // the collection specific enrichment rules file
 
 	RightsEndpoint string // the endpoint for getting use policy (as part of the enrichment process)
 	OembedRoot     string // the oembed url root
 
+	RightsBatchEndpoint  string // the endpoint for getting the use policy of several PIDs at once (optional)
+	RightsCacheSize      int    // the maximum number of PID rights policies we cache, 0 to disable
+	RightsCacheTTL       int    // how long we cache PID rights policies (in seconds)
+	RightsAggregation    string // how part policies are combined: "all" or "first"
+	RightsFallbackPolicy string // the policy used when the rights service is unavailable, fail if not set
+
+	PdfStatusConcurrency int // the maximum number of concurrent PDF status requests for a single item
+	PdfReadyCacheSize    int // the maximum number of ready PDF's we cache, 0 to disable
+	PdfReadyCacheTTL     int // how long we cache ready PDF's (in seconds)
+
 	DigitalContentCacheRoot   string // the root url of the digital content cache
 	DigitalContentCacheBucket string // the name of the bucket for the digital content cache
+	ContentCacheStore         string // where the digital content cache is stored: "s3", "file:<directory>" or "memory"
+	ContentHashIndexSize      int    // the number of content hashes we remember locally to avoid checking the store, 0 (the default) to disable, see WriteWithHash
+	CacheWithdrawnPolicy      string // what to do with the cache entries of items no longer in Tracksys: "keep", "delete" or "tombstone"
 
 	WorkerQueueSize int // the inbound message queue size to feed the workers
 	Workers         int // the number of worker processes
+	ShutdownTimeout int // how long we wait for the workers to drain during shutdown (in seconds)
+
+	HttpPort            int // the port for the embedded http server (metrics, health), 0 to disable
+	ReadyCacheAgeFactor int // the cache must be younger than this multiple of CacheAge to be ready
+	ReadyWindow         int // queue polling and worker progress must happen within this window to be ready (in seconds)
 }
 
 func ensureSet(env string) string {
@@ -59,6 +96,30 @@ func ensureSetAndNonEmpty(env string) string {
 	return val
 }
 
+func envWithDefault(env string, defaultValue string) string {
+	val, set := os.LookupEnv(env)
+
+	if set == false || val == "" {
+		return defaultValue
+	}
+
+	return val
+}
+
+func envToIntWithDefault(env string, defaultValue int) int {
+
+	number := envWithDefault(env, "")
+	if number == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		log.Printf("environment variable not an integer: [%s]", env)
+		os.Exit(1)
+	}
+	return n
+}
+
 func envToInt(env string) int {
 
 	number := ensureSetAndNonEmpty(env)
@@ -94,51 +155,172 @@ func LoadConfiguration() *ServiceConfig {
 	cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
 	cfg.PollTimeOut = int64(envToInt("VIRGO4_TRACKSYS_ENRICH_QUEUE_POLL_TIMEOUT"))
 
+	cfg.DeadLetterQueueName = envWithDefault("VIRGO4_TRACKSYS_ENRICH_DEAD_LETTER_QUEUE", "")
+	cfg.DeadLetterPolicy = envWithDefault("VIRGO4_TRACKSYS_ENRICH_DEAD_LETTER_POLICY", deadLetterPolicyForward)
+	if validDeadLetterPolicy(cfg.DeadLetterPolicy) == false {
+		log.Printf("unsupported dead letter policy: [%s]", cfg.DeadLetterPolicy)
+		os.Exit(1)
+	}
+
 	cfg.ServiceEndpoint = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_SERVICE_URL")
 	cfg.ServiceTimeout = envToInt("VIRGO4_TRACKSYS_ENRICH_SERVICE_TIMEOUT")
 
 	cfg.RightsEndpoint = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_RIGHTS_URL")
 	cfg.OembedRoot = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_OEMBED_ROOT")
 
+	cfg.RightsBatchEndpoint = envWithDefault("VIRGO4_TRACKSYS_ENRICH_RIGHTS_BATCH_URL", "")
+	cfg.RightsCacheSize = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_RIGHTS_CACHE_SIZE", 10000)
+	cfg.RightsCacheTTL = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_RIGHTS_CACHE_TTL", 300)
+	cfg.RightsAggregation = envWithDefault("VIRGO4_TRACKSYS_ENRICH_RIGHTS_AGGREGATION", rightsAggregationFirst)
+	if cfg.RightsAggregation != rightsAggregationAll && cfg.RightsAggregation != rightsAggregationFirst {
+		log.Printf("unsupported rights aggregation: [%s]", cfg.RightsAggregation)
+		os.Exit(1)
+	}
+	cfg.RightsFallbackPolicy = envWithDefault("VIRGO4_TRACKSYS_ENRICH_RIGHTS_FALLBACK_POLICY", "")
+
+	cfg.PdfStatusConcurrency = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_PDF_STATUS_CONCURRENCY", 4)
+	cfg.PdfReadyCacheSize = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_PDF_READY_CACHE_SIZE", 10000)
+	cfg.PdfReadyCacheTTL = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_PDF_READY_CACHE_TTL", 3600)
+
 	cfg.WorkerQueueSize = envToInt("VIRGO4_TRACKSYS_ENRICH_WORK_QUEUE_SIZE")
 	cfg.Workers = envToInt("VIRGO4_TRACKSYS_ENRICH_WORKERS")
+	cfg.ShutdownTimeout = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_SHUTDOWN_TIMEOUT", 30)
+
+	cfg.HttpPort = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_HTTP_PORT", 8080)
+	cfg.ReadyCacheAgeFactor = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_READY_CACHE_AGE_FACTOR", 3)
+	cfg.ReadyWindow = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_READY_WINDOW", 300)
 
 	cfg.DigitalContentCacheRoot = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_CACHE_ROOT_URL")
 	cfg.DigitalContentCacheBucket = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_CACHE_BUCKET")
+	cfg.ContentCacheStore = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_STORE", contentCacheStoreS3)
+	cfg.ContentHashIndexSize = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_CONTENT_HASH_INDEX_SIZE", 0)
+	cfg.CacheWithdrawnPolicy = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_WITHDRAWN_POLICY", cacheWithdrawnPolicyKeep)
+	if cfg.CacheWithdrawnPolicy != cacheWithdrawnPolicyKeep && cfg.CacheWithdrawnPolicy != cacheWithdrawnPolicyDelete && cfg.CacheWithdrawnPolicy != cacheWithdrawnPolicyTombstone {
+		log.Printf("unsupported cache withdrawn policy: [%s]", cfg.CacheWithdrawnPolicy)
+		os.Exit(1)
+	}
 
 	cfg.CacheLoadApi = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_CACHE_LOAD")
 	cfg.CacheDetailsApi = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_CACHE_DETAILS")
 	cfg.CacheAge = envToInt("VIRGO4_TRACKSYS_ENRICH_CACHE_AGE")
+	cfg.CacheSnapshot = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_SNAPSHOT", "")
+	// a snapshot is only useful if we can run on it for a while when Tracksys is unavailable
+	defaultGracePeriod := 0
+	if len(cfg.CacheSnapshot) != 0 {
+		defaultGracePeriod = cfg.CacheAge
+	}
+	cfg.CacheGracePeriod = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_GRACE_PERIOD", defaultGracePeriod)
+	cfg.CacheExpiredPolicy = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_EXPIRED_POLICY", cacheExpiredPolicyFatal)
+	if cfg.CacheExpiredPolicy != cacheExpiredPolicyFatal && cfg.CacheExpiredPolicy != cacheExpiredPolicyPause {
+		log.Printf("unsupported cache expired policy: [%s]", cfg.CacheExpiredPolicy)
+		os.Exit(1)
+	}
+	cfg.CacheChangeQueueName = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_CHANGE_QUEUE", "")
+	cfg.CacheChangeLimit = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_CHANGE_LIMIT", 10000)
+
+	cfg.DetailsCacheSize = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_DETAILS_CACHE_SIZE", 0)
+	cfg.DetailsCacheTTL = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_DETAILS_CACHE_TTL", 300)
 
 	cfg.PidDetailsApi = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_PID_DETAILS")
 	cfg.OcrServiceRoot = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_OCR_SERVICE_ROOT")
+	cfg.PidDetailsConcurrency = envToIntWithDefault("VIRGO4_TRACKSYS_ENRICH_PID_DETAILS_CONCURRENCY", 8)
+	if cfg.PidDetailsConcurrency < 1 {
+		log.Printf("PID details concurrency must be at least 1: [%d]", cfg.PidDetailsConcurrency)
+		os.Exit(1)
+	}
+	cfg.PidDetailsFailurePolicy = envWithDefault("VIRGO4_TRACKSYS_ENRICH_PID_DETAILS_FAILURE_POLICY", pidFailurePolicyFail)
+	if cfg.PidDetailsFailurePolicy != pidFailurePolicyFail && cfg.PidDetailsFailurePolicy != pidFailurePolicyDegrade {
+		log.Printf("unsupported PID details failure policy: [%s]", cfg.PidDetailsFailurePolicy)
+		os.Exit(1)
+	}
 
-	// maybe configure later
-	cfg.RewriteFields = map[string]string{"uva_availability_f_stored": "Online", "anon_availability_f_stored": "Online"}
+	cfg.RewriteRulesFile = envWithDefault("VIRGO4_TRACKSYS_ENRICH_REWRITE_RULES", "mappings/rewrite-rules.json")
+	cfg.PipelineFile = envWithDefault("VIRGO4_TRACKSYS_ENRICH_PIPELINE_FILE", "")
+	cfg.CollectionRulesFile = envWithDefault("VIRGO4_TRACKSYS_ENRICH_COLLECTION_RULES", "mappings/collection-rules.json")
 
 	log.Printf("[CONFIG] Mode                      = [%s]", cfg.Mode)
 	log.Printf("[CONFIG] InQueueName               = [%s]", cfg.InQueueName)
 	log.Printf("[CONFIG] OutQueueName              = [%s]", cfg.OutQueueName)
 	log.Printf("[CONFIG] PollTimeOut               = [%d]", cfg.PollTimeOut)
 	log.Printf("[CONFIG] MessageBucketName         = [%s]", cfg.MessageBucketName)
+	log.Printf("[CONFIG] DeadLetterQueueName       = [%s]", cfg.DeadLetterQueueName)
+	log.Printf("[CONFIG] DeadLetterPolicy          = [%s]", cfg.DeadLetterPolicy)
 
 	log.Printf("[CONFIG] ServiceEndpoint           = [%s]", cfg.ServiceEndpoint)
 	log.Printf("[CONFIG] ServiceTimeout            = [%d]", cfg.ServiceTimeout)
 	log.Printf("[CONFIG] CacheLoadApi              = [%s]", cfg.CacheLoadApi)
 	log.Printf("[CONFIG] CacheDetailsApi           = [%s]", cfg.CacheDetailsApi)
 	log.Printf("[CONFIG] CacheAge                  = [%d]", cfg.CacheAge)
+	log.Printf("[CONFIG] CacheGracePeriod          = [%d]", cfg.CacheGracePeriod)
+	log.Printf("[CONFIG] CacheExpiredPolicy        = [%s]", cfg.CacheExpiredPolicy)
+	log.Printf("[CONFIG] CacheSnapshot             = [%s]", cfg.CacheSnapshot)
+	log.Printf("[CONFIG] CacheChangeQueueName      = [%s]", cfg.CacheChangeQueueName)
+	log.Printf("[CONFIG] CacheChangeLimit          = [%d]", cfg.CacheChangeLimit)
+	log.Printf("[CONFIG] DetailsCacheSize          = [%d]", cfg.DetailsCacheSize)
+	log.Printf("[CONFIG] DetailsCacheTTL           = [%d]", cfg.DetailsCacheTTL)
 
 	log.Printf("[CONFIG] PidDetailsApi             = [%s]", cfg.PidDetailsApi)
 	log.Printf("[CONFIG] OcrServiceRoot            = [%s]", cfg.OcrServiceRoot)
+	log.Printf("[CONFIG] PidDetailsConcurrency     = [%d]", cfg.PidDetailsConcurrency)
+	log.Printf("[CONFIG] PidDetailsFailurePolicy   = [%s]", cfg.PidDetailsFailurePolicy)
 
 	log.Printf("[CONFIG] RightsEndpoint            = [%s]", cfg.RightsEndpoint)
 	log.Printf("[CONFIG] OembedRoot                = [%s]", cfg.OembedRoot)
+	log.Printf("[CONFIG] RightsBatchEndpoint       = [%s]", cfg.RightsBatchEndpoint)
+	log.Printf("[CONFIG] RightsCacheSize           = [%d]", cfg.RightsCacheSize)
+	log.Printf("[CONFIG] RightsCacheTTL            = [%d]", cfg.RightsCacheTTL)
+	log.Printf("[CONFIG] RightsAggregation         = [%s]", cfg.RightsAggregation)
+	log.Printf("[CONFIG] RightsFallbackPolicy      = [%s]", cfg.RightsFallbackPolicy)
+	log.Printf("[CONFIG] PdfStatusConcurrency      = [%d]", cfg.PdfStatusConcurrency)
+	log.Printf("[CONFIG] PdfReadyCacheSize         = [%d]", cfg.PdfReadyCacheSize)
+	log.Printf("[CONFIG] PdfReadyCacheTTL          = [%d]", cfg.PdfReadyCacheTTL)
+
+	log.Printf("[CONFIG] RewriteRulesFile          = [%s]", cfg.RewriteRulesFile)
+	log.Printf("[CONFIG] PipelineFile              = [%s]", cfg.PipelineFile)
+	log.Printf("[CONFIG] CollectionRulesFile       = [%s]", cfg.CollectionRulesFile)
 
 	log.Printf("[CONFIG] DigitalContentCacheRoot   = [%s]", cfg.DigitalContentCacheRoot)
 	log.Printf("[CONFIG] DigitalContentCacheBucket = [%s]", cfg.DigitalContentCacheBucket)
+	log.Printf("[CONFIG] ContentCacheStore         = [%s]", cfg.ContentCacheStore)
+	log.Printf("[CONFIG] ContentHashIndexSize      = [%d]", cfg.ContentHashIndexSize)
+	log.Printf("[CONFIG] CacheWithdrawnPolicy      = [%s]", cfg.CacheWithdrawnPolicy)
 
 	log.Printf("[CONFIG] WorkerQueueSize           = [%d]", cfg.WorkerQueueSize)
 	log.Printf("[CONFIG] Workers                   = [%d]", cfg.Workers)
+	log.Printf("[CONFIG] ShutdownTimeout           = [%d]", cfg.ShutdownTimeout)
+
+	log.Printf("[CONFIG] HttpPort                  = [%d]", cfg.HttpPort)
+	log.Printf("[CONFIG] ReadyCacheAgeFactor       = [%d]", cfg.ReadyCacheAgeFactor)
+	log.Printf("[CONFIG] ReadyWindow               = [%d]", cfg.ReadyWindow)
+
+	return &cfg
+}
+
+// LoadCacheCommandConfiguration will load the configuration the cache maintenance commands need (the
+// digital content cache and optionally Tracksys) and return a pointer to it. Any failures are fatal.
+func LoadCacheCommandConfiguration(tracksys bool) *ServiceConfig {
+
+	var cfg ServiceConfig
+
+	cfg.Mode = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_MODE")
+	cfg.DigitalContentCacheBucket = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_CACHE_BUCKET")
+	cfg.ContentCacheStore = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_STORE", contentCacheStoreS3)
+	cfg.CacheSnapshot = envWithDefault("VIRGO4_TRACKSYS_ENRICH_CACHE_SNAPSHOT", "")
+
+	log.Printf("[CONFIG] Mode                      = [%s]", cfg.Mode)
+	log.Printf("[CONFIG] DigitalContentCacheBucket = [%s]", cfg.DigitalContentCacheBucket)
+	log.Printf("[CONFIG] ContentCacheStore         = [%s]", cfg.ContentCacheStore)
+	log.Printf("[CONFIG] CacheSnapshot             = [%s]", cfg.CacheSnapshot)
+
+	if tracksys == true {
+		cfg.ServiceEndpoint = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_SERVICE_URL")
+		cfg.ServiceTimeout = envToInt("VIRGO4_TRACKSYS_ENRICH_SERVICE_TIMEOUT")
+		cfg.CacheLoadApi = ensureSetAndNonEmpty("VIRGO4_TRACKSYS_ENRICH_CACHE_LOAD")
+
+		log.Printf("[CONFIG] ServiceEndpoint           = [%s]", cfg.ServiceEndpoint)
+		log.Printf("[CONFIG] ServiceTimeout            = [%d]", cfg.ServiceTimeout)
+		log.Printf("[CONFIG] CacheLoadApi              = [%s]", cfg.CacheLoadApi)
+	}
 
 	return &cfg
 }
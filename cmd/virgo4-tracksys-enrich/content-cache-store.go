@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// the content cache store configuration values
+var contentCacheStoreS3 = "s3"
+var contentCacheStoreMemory = "memory"
+var contentCacheStoreFilePrefix = "file:"
+
+// ContentCacheStore - the digital content cache storage
+type ContentCacheStore interface {
+
+	// write the cache element
+	Write(string, string) error
+
+	// write the cache element unless the existing element has identical content (or we are forced to),
+	// returns true if the element was written
+	WriteIfChanged(string, string, bool) (bool, error)
+
+	// WriteIfChanged where the caller determines the content hash
+	WriteWithHash(string, string, string, bool) (bool, error)
+
+	// read the cache element
+	Read(string) ([]byte, error)
+
+	// does the cache element exist
+	Exists(string) (bool, error)
+
+	// delete the cache element
+	Delete(string) error
+
+	// list the keys of the cache elements with the specified prefix
+	List(string) ([]string, error)
+}
+
+// contentCacheBackend - the operations an actual storage implementation provides
+type contentCacheBackend interface {
+	put(string, []byte, string) error // store the content and its hash
+	get(string) ([]byte, error)       // get the content
+	hash(string) (string, error)      // get the content hash, an error if the element does not exist
+	exists(string) (bool, error)      // does the element exist
+	remove(string) error              // remove the element
+	list(string) ([]string, error)    // the keys with the prefix
+	location(string) string           // where the element is, for logging
+}
+
+// this is our actual implementation
+type contentCacheStoreImpl struct {
+	backend contentCacheBackend        // the storage implementation
+	hashes  *lru.Cache[string, string] // the hashes of the content recently written or seen, nil if not configured (see below)
+	remote  bool                       // is the backend S3, only those skipped writes are uploads saved
+}
+
+// NewContentCacheStore - the factory, the service creates a single store that is shared by all the workers
+// so they share the hash index (and the memory store)
+func NewContentCacheStore(config *ServiceConfig) (ContentCacheStore, error) {
+
+	var err error
+	impl := &contentCacheStoreImpl{}
+	switch {
+	case config.ContentCacheStore == contentCacheStoreS3:
+		impl.backend, err = newS3ContentCache(config)
+		impl.remote = true
+	case config.ContentCacheStore == contentCacheStoreMemory:
+		impl.backend = newMemoryContentCache()
+	case strings.HasPrefix(config.ContentCacheStore, contentCacheStoreFilePrefix) == true:
+		impl.backend, err = newFileContentCache(strings.TrimPrefix(config.ContentCacheStore, contentCacheStoreFilePrefix))
+	default:
+		err = fmt.Errorf("unsupported content cache store [%s]", config.ContentCacheStore)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ContentHashIndexSize > 0 {
+		impl.hashes, _ = lru.New[string, string](config.ContentHashIndexSize)
+	}
+	return impl, nil
+}
+
+func (cs *contentCacheStoreImpl) Write(key string, content string) error {
+	_, err := cs.WriteWithHash(key, content, contentHash(content), true)
+	return err
+}
+
+func (cs *contentCacheStoreImpl) WriteIfChanged(key string, content string, force bool) (bool, error) {
+	return cs.WriteWithHash(key, content, contentHash(content), force)
+}
+
+func (cs *contentCacheStoreImpl) WriteWithHash(key string, content string, hash string, force bool) (bool, error) {
+
+	if force == false {
+
+		// have we recently written or seen this content. The index only knows about our own writes and
+		// deletes so it is strictly opt-in, an entry deleted or withdrawn elsewhere (the cache sweep or
+		// another replica) is not rewritten while its hash is remembered here
+		if cs.hashes != nil {
+			if known, found := cs.hashes.Get(key); found == true && known == hash {
+				cs.skipped()
+				log.Printf("INFO: %s is unchanged (local index), skipping upload", cs.backend.location(key))
+				return false, nil
+			}
+		}
+
+		// otherwise ask the backend, any error means we simply write the content
+		existing, err := cs.backend.hash(key)
+		if err == nil && existing == hash {
+			cs.skipped()
+			log.Printf("INFO: %s is unchanged, skipping upload", cs.backend.location(key))
+			if cs.hashes != nil {
+				cs.hashes.Add(key, hash)
+			}
+			return false, nil
+		}
+	}
+
+	err := cs.backend.put(key, []byte(content), hash)
+	if err != nil {
+		return false, err
+	}
+	if cs.hashes != nil {
+		cs.hashes.Add(key, hash)
+	}
+	return true, nil
+}
+
+func (cs *contentCacheStoreImpl) Read(key string) ([]byte, error) {
+	return cs.backend.get(key)
+}
+
+func (cs *contentCacheStoreImpl) Exists(key string) (bool, error) {
+	return cs.backend.exists(key)
+}
+
+func (cs *contentCacheStoreImpl) Delete(key string) error {
+	if cs.hashes != nil {
+		cs.hashes.Remove(key)
+	}
+	return cs.backend.remove(key)
+}
+
+func (cs *contentCacheStoreImpl) List(prefix string) ([]string, error) {
+	return cs.backend.list(prefix)
+}
+
+// record a skipped write, the metric only counts the S3 uploads we avoided
+func (cs *contentCacheStoreImpl) skipped() {
+	if cs.remote == true {
+		s3UploadsSkipped.Inc()
+	}
+}
+
+// the hash of the supplied content
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// in memory storage, for development and testing
+//
+
+type memoryContentCache struct {
+	content map[string][]byte
+	hashes  map[string]string
+	mu      sync.RWMutex
+}
+
+func newMemoryContentCache() *memoryContentCache {
+	return &memoryContentCache{content: make(map[string][]byte), hashes: make(map[string]string)}
+}
+
+func (mc *memoryContentCache) put(key string, content []byte, hash string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.content[key] = append([]byte(nil), content...)
+	mc.hashes[key] = hash
+	return nil
+}
+
+func (mc *memoryContentCache) get(key string) ([]byte, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	content, found := mc.content[key]
+	if found == false {
+		return nil, fmt.Errorf("%s does not exist", mc.location(key))
+	}
+	return append([]byte(nil), content...), nil
+}
+
+func (mc *memoryContentCache) hash(key string) (string, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	hash, found := mc.hashes[key]
+	if found == false {
+		return "", fmt.Errorf("%s does not exist", mc.location(key))
+	}
+	return hash, nil
+}
+
+func (mc *memoryContentCache) exists(key string) (bool, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	_, found := mc.content[key]
+	return found, nil
+}
+
+func (mc *memoryContentCache) remove(key string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.content, key)
+	delete(mc.hashes, key)
+	return nil
+}
+
+func (mc *memoryContentCache) list(prefix string) ([]string, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	keys := make([]string, 0)
+	for k := range mc.content {
+		if strings.HasPrefix(k, prefix) == true {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (mc *memoryContentCache) location(key string) string {
+	return fmt.Sprintf("memory:%s", key)
+}
+
+//
+// local filesystem storage, the content hashes are kept in a parallel directory tree
+//
+
+// the directory (under the root) that holds the content hashes
+var fileContentHashDir = ".hashes"
+
+type fileContentCache struct {
+	root string
+}
+
+func newFileContentCache(root string) (*fileContentCache, error) {
+	if len(root) == 0 {
+		return nil, fmt.Errorf("no content cache directory")
+	}
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &fileContentCache{root: root}, nil
+}
+
+func (fc *fileContentCache) put(key string, content []byte, hash string) error {
+	log.Printf("INFO: writing %s (%d bytes)", fc.location(key), len(content))
+	err := writeFileAtomic(fc.path(key), content)
+	if err != nil {
+		log.Printf("ERROR: writing %s (%s)", fc.location(key), err.Error())
+		return err
+	}
+	return writeFileAtomic(fc.hashPath(key), []byte(hash))
+}
+
+func (fc *fileContentCache) get(key string) ([]byte, error) {
+	return ioutil.ReadFile(fc.path(key))
+}
+
+func (fc *fileContentCache) hash(key string) (string, error) {
+	_, err := os.Stat(fc.path(key))
+	if err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(fc.hashPath(key))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (fc *fileContentCache) exists(key string) (bool, error) {
+	_, err := os.Stat(fc.path(key))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) == true {
+		return false, nil
+	}
+	return false, err
+}
+
+func (fc *fileContentCache) remove(key string) error {
+	err := os.Remove(fc.path(key))
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	err = os.Remove(fc.hashPath(key))
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return nil
+}
+
+func (fc *fileContentCache) list(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.Walk(fc.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(fc.root, path)
+		key := filepath.ToSlash(rel)
+		if info.IsDir() == true {
+			if key == fileContentHashDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) == true {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (fc *fileContentCache) location(key string) string {
+	return fmt.Sprintf("file://%s", fc.path(key))
+}
+
+func (fc *fileContentCache) path(key string) string {
+	return filepath.Join(fc.root, filepath.FromSlash(key))
+}
+
+func (fc *fileContentCache) hashPath(key string) string {
+	return filepath.Join(fc.root, fileContentHashDir, filepath.FromSlash(key))
+}
+
+// write to a temp file and rename so we never leave a partial file behind
+func writeFileAtomic(filename string, content []byte) error {
+
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestContentCacheStore(t *testing.T) {
+
+	fileBackend, err := newFileContentCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	index, _ := lru.New[string, string](10)
+
+	backends := []struct {
+		name  string
+		store *contentCacheStoreImpl
+	}{
+		{"memory", &contentCacheStoreImpl{backend: newMemoryContentCache()}},
+		{"memory with index", &contentCacheStoreImpl{backend: newMemoryContentCache(), hashes: index}},
+		{"file", &contentCacheStoreImpl{backend: fileBackend}},
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			cs := b.store
+
+			// the usual write, skip, change sequence
+			writes := []struct {
+				content string
+				hash    string
+				force   bool
+				written bool
+			}{
+				{"one", "h1", false, true},
+				{"one", "h1", false, false},
+				{"one, regenerated", "h1", false, false}, // the caller decides what makes the content different
+				{"one", "h1", true, true},
+				{"two", "h2", false, true},
+			}
+			for ix, w := range writes {
+				written, err := cs.WriteWithHash("a/1", w.content, w.hash, w.force)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if written != w.written {
+					t.Errorf("write %d: expected written %t, got %t", ix, w.written, written)
+				}
+			}
+
+			buf, err := cs.Read("a/1")
+			if err != nil || string(buf) != "two" {
+				t.Errorf("expected the last written content, got %q (%v)", string(buf), err)
+			}
+
+			// the content hash is used when the caller does not supply one
+			written, err := cs.WriteIfChanged("a/2", "three", false)
+			if err != nil || written == false {
+				t.Errorf("expected a write, got %t (%v)", written, err)
+			}
+			written, _ = cs.WriteWithHash("a/2", "three", contentHash("three"), false)
+			if written == true {
+				t.Errorf("expected the content hash to match")
+			}
+			_ = cs.Write("b/1", "four")
+
+			keys, err := cs.List("a/")
+			if err != nil || reflect.DeepEqual(keys, []string{"a/1", "a/2"}) == false {
+				t.Errorf("unexpected keys %v (%v)", keys, err)
+			}
+
+			err = cs.Delete("a/1")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for key, expected := range map[string]bool{"a/1": false, "a/2": true, "b/1": true, "c/1": false} {
+				exists, err := cs.Exists(key)
+				if err != nil || exists != expected {
+					t.Errorf("%s: expected exists %t, got %t (%v)", key, expected, exists, err)
+				}
+			}
+			if err = cs.Delete("a/1"); err != nil {
+				t.Errorf("deleting a missing element is not an error, got %s", err)
+			}
+
+			// a deleted element is written again, even with the same content
+			written, _ = cs.WriteWithHash("a/1", "two", "h2", false)
+			if written == false {
+				t.Errorf("expected a deleted element to be written")
+			}
+		})
+	}
+}
+
+// entries deleted or withdrawn outside the store (the cache sweep or another replica) must be written again
+func TestContentCacheStoreExternalDelete(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		external func(contentCacheBackend)
+	}{
+		{"deleted", func(b contentCacheBackend) { _ = b.remove("u1") }},
+		{"tombstoned", func(b contentCacheBackend) { _ = b.put("u1", []byte(`{"id":"u1","withdrawn":true}`), "tombstone") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the default configuration has no local hash index
+			store, err := NewContentCacheStore(testConfig())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			cs := store.(*contentCacheStoreImpl)
+			_, _ = cs.WriteWithHash("u1", "one", "h1", false)
+
+			tt.external(cs.backend)
+
+			written, err := cs.WriteWithHash("u1", "one", "h1", false)
+			if err != nil || written == false {
+				t.Fatalf("expected the entry to be written again, got %t (%v)", written, err)
+			}
+			buf, _ := cs.Read("u1")
+			if string(buf) != "one" {
+				t.Errorf("expected the entry content, got %s", string(buf))
+			}
+		})
+	}
+}
+
+func TestContentCacheStoreSkipMetric(t *testing.T) {
+
+	for _, remote := range []bool{false, true} {
+		cs := &contentCacheStoreImpl{backend: newMemoryContentCache(), remote: remote}
+		before := counterValue(s3UploadsSkipped)
+		_, _ = cs.WriteWithHash("a/1", "one", "h1", false)
+		_, _ = cs.WriteWithHash("a/1", "one", "h1", false)
+
+		// only the S3 uploads we avoid are counted
+		counted := counterValue(s3UploadsSkipped) - before
+		if (counted == 1) != remote {
+			t.Errorf("remote %t: unexpected skipped count %v", remote, counted)
+		}
+	}
+}
+
+// the current value of the counter
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	_ = c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+//
+// end of file
+//
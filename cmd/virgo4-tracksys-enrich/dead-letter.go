@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the available policies for records that fail the enrich pipeline
+var deadLetterPolicyForward = "forward"       // forward the record anyway (the historical behavior)
+var deadLetterPolicyDeadLetter = "deadletter" // publish the record to the dead letter queue only
+var deadLetterPolicyBoth = "both"             // forward the record and publish to the dead letter queue
+
+// the attributes added to dead lettered messages
+var deadLetterStepIndexAttributeName = "enrich-failed-step-index"
+var deadLetterStepNameAttributeName = "enrich-failed-step-name"
+var deadLetterErrorAttributeName = "enrich-error"
+
+// DeadLetter - routing for records whose enrich pipeline fails
+type DeadLetter struct {
+	policy string             // the configured policy
+	queue  awssqs.QueueHandle // the dead letter queue, if configured
+}
+
+// NewDeadLetter - the factory
+func NewDeadLetter(config *ServiceConfig, aws awssqs.AWS_SQS) (*DeadLetter, error) {
+
+	dl := &DeadLetter{policy: config.DeadLetterPolicy}
+	if dl.policy == deadLetterPolicyForward {
+		return dl, nil
+	}
+
+	if len(config.DeadLetterQueueName) == 0 {
+		return nil, fmt.Errorf("dead letter policy [%s] requires a dead letter queue", dl.policy)
+	}
+
+	queue, err := aws.QueueHandle(config.DeadLetterQueueName)
+	if err != nil {
+		return nil, err
+	}
+	dl.queue = queue
+	return dl, nil
+}
+
+// Forward - should records that fail enrichment be forwarded to the outbound queue
+func (dl *DeadLetter) Forward() bool {
+	return deadLetterForwards(dl.policy)
+}
+
+// Publish - should records that fail enrichment be published to the dead letter queue
+func (dl *DeadLetter) Publish() bool {
+	return dl.policy == deadLetterPolicyDeadLetter || dl.policy == deadLetterPolicyBoth
+}
+
+// Queue - the dead letter queue handle
+func (dl *DeadLetter) Queue() awssqs.QueueHandle {
+	return dl.queue
+}
+
+// MakeMessage - create the dead letter message from the original message details and the failure information
+func (dl *DeadLetter) MakeMessage(attribs awssqs.Attributes, payload []byte, step int, stepName string, err error) awssqs.Message {
+
+	// copy the attributes so we do not disturb the original message
+	newAttribs := make(awssqs.Attributes, 0, len(attribs)+3)
+	newAttribs = append(newAttribs, attribs...)
+	newAttribs = append(newAttribs, awssqs.Attribute{Name: deadLetterStepIndexAttributeName, Value: strconv.Itoa(step)})
+	newAttribs = append(newAttribs, awssqs.Attribute{Name: deadLetterStepNameAttributeName, Value: stepName})
+	newAttribs = append(newAttribs, awssqs.Attribute{Name: deadLetterErrorAttributeName, Value: err.Error()})
+
+	return awssqs.Message{Attribs: newAttribs, Payload: payload}
+}
+
+// deadLetterForwards - does the supplied policy forward records that fail enrichment
+func deadLetterForwards(policy string) bool {
+	return policy == deadLetterPolicyForward || policy == deadLetterPolicyBoth
+}
+
+// validDeadLetterPolicy - is the supplied policy one we support
+func validDeadLetterPolicy(policy string) bool {
+	return policy == deadLetterPolicyForward || policy == deadLetterPolicyDeadLetter || policy == deadLetterPolicyBoth
+}
+
+//
+// end of file
+//
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// the details cache holds recent Tracksys lookup results so repeated requests for the same item (common during
+// a reindex) do not go back to Tracksys. Entries expire after a short time and the whole cache is purged whenever
+// the Tracksys ID cache is reloaded
+
+// DetailsCache - our interface
+type DetailsCache interface {
+	GetItem(string) (*TracksysSirsiItem, bool)
+	SetItem(string, *TracksysSirsiItem)
+	GetPid(string) (*TracksysPidItem, bool)
+	SetPid(string, *TracksysPidItem)
+	Purge()
+}
+
+// our implementation
+type detailsCacheImpl struct {
+	items *expirable.LRU[string, TracksysSirsiItem]
+	pids  *expirable.LRU[string, TracksysPidItem]
+}
+
+// NewDetailsCache - the factory, returns nil if the details cache is not configured
+func NewDetailsCache(config *ServiceConfig) DetailsCache {
+
+	if config.DetailsCacheSize <= 0 || config.DetailsCacheTTL <= 0 {
+		return nil
+	}
+
+	ttl := time.Duration(config.DetailsCacheTTL) * time.Second
+	impl := &detailsCacheImpl{}
+	impl.items = expirable.NewLRU[string, TracksysSirsiItem](config.DetailsCacheSize, nil, ttl)
+	impl.pids = expirable.NewLRU[string, TracksysPidItem](config.DetailsCacheSize, nil, ttl)
+	return impl
+}
+
+// GetItem - get a copy of the cached item if we have one
+func (dc *detailsCacheImpl) GetItem(id string) (*TracksysSirsiItem, bool) {
+
+	item, found := dc.items.Get(id)
+	if found == false {
+		detailsCacheLookups.WithLabelValues("item", "miss").Inc()
+		return nil, false
+	}
+	detailsCacheLookups.WithLabelValues("item", "hit").Inc()
+	return copySirsiItem(&item), true
+}
+
+// SetItem - cache a copy of the item
+func (dc *detailsCacheImpl) SetItem(id string, item *TracksysSirsiItem) {
+	dc.items.Add(id, *copySirsiItem(item))
+}
+
+// GetPid - get a copy of the cached PID item if we have one
+func (dc *detailsCacheImpl) GetPid(pid string) (*TracksysPidItem, bool) {
+
+	item, found := dc.pids.Get(pid)
+	if found == false {
+		detailsCacheLookups.WithLabelValues("pid", "miss").Inc()
+		return nil, false
+	}
+	detailsCacheLookups.WithLabelValues("pid", "hit").Inc()
+	return &item, true
+}
+
+// SetPid - cache a copy of the PID item
+func (dc *detailsCacheImpl) SetPid(pid string, item *TracksysPidItem) {
+	dc.pids.Add(pid, *item)
+}
+
+// Purge - remove everything
+func (dc *detailsCacheImpl) Purge() {
+	dc.items.Purge()
+	dc.pids.Purge()
+}
+
+// the pipeline steps may modify the item so we never share the parts with the cache
+func copySirsiItem(item *TracksysSirsiItem) *TracksysSirsiItem {
+
+	newItem := *item
+	newItem.Items = make([]TracksysPart, len(item.Items))
+	copy(newItem.Items, item.Items)
+	return &newItem
+}
+
+//
+// end of file
+//
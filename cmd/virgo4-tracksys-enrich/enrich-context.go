@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
+)
+
+// ContextItem - identifies an item of the enrich context that a step reads or writes
+type ContextItem string
+
+// the items available in the enrich context
+const (
+	ContextRecordId  ContextItem = "record id"       // always available
+	ContextSolrDoc   ContextItem = "solr document"   // always available
+	ContextTracksys  ContextItem = "tracksys item"   // provided by the tracksys extract step
+	ContextRights    ContextItem = "rights"          // provided by the tracksys enrich step
+	ContextPdfStatus ContextItem = "pdf status"      // provided by the tracksys enrich step
+	ContextCacheUrl  ContextItem = "metadata cache"  // provided by the metadata cache step
+	ContextDigitized ContextItem = "digitized state" // provided by the partial digitized step
+	ContextManifest  ContextItem = "iiif manifest"   // provided by the IIIF manifest step
+)
+
+// the items available before any step has run
+var initialContextItems = []ContextItem{ContextRecordId, ContextSolrDoc}
+
+// EnrichContext - the state carried through the enrich pipeline for a single record
+type EnrichContext struct {
+	RecordId string             // the record identifier (from the message attributes)
+	Mode     string             // the service mode
+	Message  *awssqs.Message    // the message being enriched
+	Tracksys *TracksysSirsiItem // the Tracksys details for the record
+
+	Rights    map[string]string // the rights policy by PID (only the first PID unless aggregating all)
+	PdfStatus map[string]string // the PDF status by PID
+	CacheUrl  string            // the url of the metadata cache entry
+	Digitized string            // the digitized state
+	Manifests []string          // the urls of the cached IIIF manifests
+
+	ManifestSummarySize int // the total size of the IIIF manifest summary fields across all the parts
+
+	Warnings []string // any warnings raised during enrichment
+
+	add     *solrdoc.AddDoc // the parsed payload, parsed on first use
+	adds    []solrdoc.Field // the fields to be added
+	removes []string        // the fields to be removed
+}
+
+// NewEnrichContext - the factory
+func NewEnrichContext(mode string, message *awssqs.Message) *EnrichContext {
+
+	ctx := &EnrichContext{Mode: mode, Message: message}
+	ctx.RecordId, _ = message.GetAttribute(awssqs.AttributeKeyRecordId)
+	ctx.Rights = make(map[string]string)
+	ctx.PdfStatus = make(map[string]string)
+	return ctx
+}
+
+// Document - the Solr document (as received, without any of the pending changes)
+func (ctx *EnrichContext) Document() (*solrdoc.Document, error) {
+
+	if ctx.add == nil {
+		add, err := ParsePayload(ctx.Message)
+		if err != nil {
+			return nil, err
+		}
+		ctx.add = add
+	}
+	return ctx.add.Doc(), nil
+}
+
+// AddField - add values for the named field once the pipeline completes
+func (ctx *EnrichContext) AddField(name string, values ...string) {
+	for _, v := range values {
+		ctx.adds = append(ctx.adds, solrdoc.Field{Name: name, Value: v})
+	}
+}
+
+// AddFields - add the fields once the pipeline completes
+func (ctx *EnrichContext) AddFields(fields ...solrdoc.Field) {
+	ctx.adds = append(ctx.adds, fields...)
+}
+
+// RemoveField - remove the named field (as received) once the pipeline completes
+func (ctx *EnrichContext) RemoveField(name string) {
+	ctx.removes = append(ctx.removes, name)
+}
+
+// Field - the current values of the named field, the values as received (unless removed) followed by any
+// pending additions
+func (ctx *EnrichContext) Field(name string) ([]string, error) {
+
+	values := make([]string, 0)
+	if ctx.removing(name) == false {
+		doc, err := ctx.Document()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, doc.Get(name)...)
+	}
+	for _, f := range ctx.adds {
+		if f.Name == name {
+			values = append(values, f.Value)
+		}
+	}
+	return values, nil
+}
+
+// ReplaceField - replace all the current values (as received and pending) of the named field
+func (ctx *EnrichContext) ReplaceField(name string, values ...string) {
+
+	if ctx.removing(name) == false {
+		ctx.RemoveField(name)
+	}
+
+	kept := ctx.adds[:0]
+	for _, f := range ctx.adds {
+		if f.Name != name {
+			kept = append(kept, f)
+		}
+	}
+	ctx.adds = kept
+
+	ctx.AddField(name, values...)
+}
+
+// is the named field (as received) to be removed
+func (ctx *EnrichContext) removing(name string) bool {
+	for _, r := range ctx.removes {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Warning - note a non-fatal problem with the record
+func (ctx *EnrichContext) Warning(warning string) {
+	ctx.Warnings = append(ctx.Warnings, warning)
+}
+
+// the pending field changes at a point in the pipeline
+type pendingChanges struct {
+	adds    []solrdoc.Field
+	removes []string
+}
+
+// the pending field changes so far, so the changes of a failing step can be rolled back
+func (ctx *EnrichContext) checkpoint() pendingChanges {
+	return pendingChanges{
+		adds:    append([]solrdoc.Field(nil), ctx.adds...),
+		removes: append([]string(nil), ctx.removes...),
+	}
+}
+
+// restore the pending field changes to an earlier checkpoint
+func (ctx *EnrichContext) rollback(changes pendingChanges) {
+	ctx.adds = changes.adds
+	ctx.removes = changes.removes
+}
+
+// Discard - discard the pending field changes, the message payload is left as received
+func (ctx *EnrichContext) Discard() {
+
+	for _, w := range ctx.Warnings {
+		log.Printf("WARNING: id %s: %s", ctx.RecordId, w)
+	}
+	ctx.adds = nil
+	ctx.removes = nil
+}
+
+// Apply - apply the pending field changes to the message payload. Removals apply to the fields as
+// received and additions are appended in the order they were made
+func (ctx *EnrichContext) Apply() error {
+
+	for _, w := range ctx.Warnings {
+		log.Printf("WARNING: id %s: %s", ctx.RecordId, w)
+	}
+
+	if len(ctx.adds) == 0 && len(ctx.removes) == 0 {
+		return nil
+	}
+
+	doc, err := ctx.Document()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range ctx.removes {
+		doc.Remove(name)
+	}
+	doc.AppendFields(ctx.adds...)
+
+	UpdatePayload(ctx.Message, ctx.add)
+	return nil
+}
+
+//
+// end of file
+//
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
+	"time"
 )
 
 // PipelineStep - the interface representing a processing step of the enrich pipeline
 type PipelineStep interface {
 
-	// the name of the step
+	// the name of the step (as registered)
 	Name() string
 
-	// process the provided message and return:
+	// the context items this step reads (must be provided by an earlier step)
+	Requires() []ContextItem
+
+	// the context items this step writes
+	Provides() []ContextItem
+
+	// process the provided context and return:
 	//    bool        - should the pipeline continue to the next step?
-	//    interface{} - anything to be passed to the next step
 	//    error       - did an error occur?
-	Process(*awssqs.Message, interface{}) (bool, interface{}, error)
+	Process(*EnrichContext) (bool, error)
 }
 
 // Pipeline - the interface representing the complete enrich pipeline
@@ -25,50 +32,80 @@ type Pipeline interface {
 	//    int   - the step that failed or -1 if successful
 	//    error - did an error occur?
 	Process(*awssqs.Message) (int, error)
+
+	// the name of the specified step
+	StepName(int) string
 }
 
 // this is our actual pipeline implementation
 type pipelineImpl struct {
-	steps []PipelineStep // the individual steps of the enrich pipeline
+	mode    string         // the service mode
+	forward bool           // are documents that fail enrichment forwarded
+	steps   []PipelineStep // the individual steps of the enrich pipeline
 }
 
 // NewEnrichPipeline - the factory for the enrich pipeline
-func NewEnrichPipeline(config *ServiceConfig) Pipeline {
+func NewEnrichPipeline(config *ServiceConfig, store ContentCacheStore) (Pipeline, error) {
 
 	// mock implementation here if necessary
 
-	impl := &pipelineImpl{}
-	impl.steps = make([]PipelineStep, 0)
+	impl := &pipelineImpl{mode: config.Mode, forward: deadLetterForwards(config.DeadLetterPolicy)}
 
-	// the pipeline consists of 4 possible steps:
+	// by default, the pipeline consists of 6 possible steps:
+	//  0. cache withdraw step (only if a withdrawn policy is configured)
 	//  1. tracksys extract step
 	//  2. tracksys enrich step (only fir Sirsi items)
 	//  3. field rewrite step
 	//  4. partial digitization step
 	//  5. metadata cache step
+	// although a different pipeline can be defined by configuration
+
+	def, err := LoadPipelineDefinition(config)
+	if err != nil {
+		return nil, err
+	}
+
+	impl.steps, err = resolvePipeline(config, store, def)
+	if err != nil {
+		return nil, err
+	}
 
-	impl.steps = append(impl.steps, NewTracksysExtractStep(config))
-	if config.Mode == "sirsi" {
-		impl.steps = append(impl.steps, NewTracksysEnrichStep(config))
+	err = validatePipeline(impl.steps)
+	if err != nil {
+		return nil, err
 	}
-	impl.steps = append(impl.steps, NewFieldRewriteStep(config))
-	impl.steps = append(impl.steps, NewPartialDigitizedStep(config))
-	impl.steps = append(impl.steps, NewMetaDataCacheStep(config))
 
 	log.Printf("INFO: enrich pipeline configured with %d steps", len(impl.steps))
-	return impl
+	return impl, nil
 }
 
 func (pi *pipelineImpl) Process(message *awssqs.Message) (int, error) {
 
-	var payload interface{}
+	ctx := NewEnrichContext(pi.mode, message)
+
 	for ix, step := range pi.steps {
 		//log.Printf("DEBUG: running step %d (%s)", ix, step.Name())
-		doNext, data, err := step.Process(message, payload)
+		saved := ctx.checkpoint()
+		start := time.Now()
+		doNext, err := step.Process(ctx)
+		stepDuration.WithLabelValues(step.Name()).Observe(time.Since(start).Seconds())
 
 		// error happened during a step
 		if err != nil {
+			stepErrors.WithLabelValues(step.Name()).Inc()
 			log.Printf("ERROR: enrich pipeline failed at step %d (%s)", ix, step.Name())
+
+			// a forwarded document gets the changes of the steps that succeeded (but none from the failed
+			// one), otherwise it is dead lettered as received
+			ctx.rollback(saved)
+			if pi.forward == true {
+				if applyErr := ctx.Apply(); applyErr != nil {
+					log.Printf("ERROR: enrich pipeline failed applying changes before step %d (%s)", ix, step.Name())
+				}
+			} else {
+				ctx.Discard()
+			}
+
 			// return step number and error
 			return ix, err
 		}
@@ -77,17 +114,54 @@ func (pi *pipelineImpl) Process(message *awssqs.Message) (int, error) {
 		if doNext == false {
 			//log.Printf("INFO: enrich pipeline exited early at step %d (%s)", ix, step.Name())
 			// all is well
-			return -1, nil
+			return pi.complete(ctx, ix)
 		}
-
-		// to pass on to the next step
-		payload = data
 	}
 
 	// done all the steps and all is well
+	return pi.complete(ctx, len(pi.steps)-1)
+}
+
+func (pi *pipelineImpl) StepName(step int) string {
+	if step < 0 || step >= len(pi.steps) {
+		return "unknown"
+	}
+	return pi.steps[step].Name()
+}
+
+// apply the accumulated changes once the pipeline has completed
+func (pi *pipelineImpl) complete(ctx *EnrichContext, last int) (int, error) {
+
+	err := ctx.Apply()
+	if err != nil {
+		log.Printf("ERROR: enrich pipeline failed applying changes after step %d (%s)", last, pi.steps[last].Name())
+		return last, err
+	}
 	return -1, nil
 }
 
+// ensure every step only requires context items provided by the steps before it
+func validatePipeline(steps []PipelineStep) error {
+
+	available := make(map[ContextItem]bool)
+	for _, item := range initialContextItems {
+		available[item] = true
+	}
+
+	for ix, step := range steps {
+		for _, item := range step.Requires() {
+			if available[item] == false {
+				return fmt.Errorf("pipeline step %d (%s) requires %s which is not provided by an earlier step", ix, step.Name(), item)
+			}
+		}
+		for _, item := range step.Provides() {
+			available[item] = true
+		}
+	}
+
+	return nil
+}
+
 //
 // end of file
 //
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// a step that adds a field and optionally fails or stops the pipeline
+type testStep struct {
+	field string
+	stop  bool
+	err   error
+}
+
+func (ts *testStep) Name() string            { return ts.field }
+func (ts *testStep) Requires() []ContextItem { return []ContextItem{} }
+func (ts *testStep) Provides() []ContextItem { return []ContextItem{} }
+
+func (ts *testStep) Process(ctx *EnrichContext) (bool, error) {
+	ctx.AddField(ts.field, "value")
+	return ts.stop == false, ts.err
+}
+
+func testMessage(id string, payload string) *awssqs.Message {
+	return &awssqs.Message{
+		Attribs: awssqs.Attributes{{Name: awssqs.AttributeKeyRecordId, Value: id}},
+		Payload: []byte(payload),
+	}
+}
+
+func TestPipelineProcess(t *testing.T) {
+
+	payload := `<add><doc><field name="id">u1</field></doc></add>`
+	tests := []struct {
+		name     string
+		steps    []PipelineStep
+		forward  bool
+		failed   int
+		expected string
+	}{
+		{
+			"all steps",
+			[]PipelineStep{&testStep{field: "a"}, &testStep{field: "b"}},
+			true,
+			-1,
+			`<add><doc><field name="id">u1</field><field name="a">value</field><field name="b">value</field></doc></add>`,
+		},
+		{
+			"stopped early",
+			[]PipelineStep{&testStep{field: "a", stop: true}, &testStep{field: "b"}},
+			true,
+			-1,
+			`<add><doc><field name="id">u1</field><field name="a">value</field></doc></add>`,
+		},
+		{
+			"failed last step forwards the earlier changes",
+			[]PipelineStep{&testStep{field: "a"}, &testStep{field: "b"}, &testStep{field: "c", err: fmt.Errorf("failed")}},
+			true,
+			2,
+			`<add><doc><field name="id">u1</field><field name="a">value</field><field name="b">value</field></doc></add>`,
+		},
+		{
+			"failed first step forwards as received",
+			[]PipelineStep{&testStep{field: "a", err: fmt.Errorf("failed")}, &testStep{field: "b"}},
+			true,
+			0,
+			payload,
+		},
+		{
+			"failed step discards the pending changes when dead lettered",
+			[]PipelineStep{&testStep{field: "a"}, &testStep{field: "b", err: fmt.Errorf("failed")}},
+			false,
+			1,
+			payload,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := &pipelineImpl{mode: "sirsi", forward: tt.forward, steps: tt.steps}
+			message := testMessage("u1", payload)
+			failed, err := pipeline.Process(message)
+			if failed != tt.failed || (err != nil) != (tt.failed != -1) {
+				t.Fatalf("expected step %d to fail, got %d (%v)", tt.failed, failed, err)
+			}
+			if string(message.Payload) != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, message.Payload)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
+)
+
+// the default Tracksys to Solr field mapping
+var defaultFieldMappingFile = "mappings/tracksys-enrich-fields.json"
+
+// sources prefixed with this are taken from each part of the item
+var partSourcePrefix = "part."
+
+// FieldMapping - the declarative mapping of Tracksys attributes to Solr fields
+type FieldMapping struct {
+	Fields []FieldMappingEntry `json:"fields"`
+}
+
+// FieldMappingEntry - a single output field, either from a Tracksys attribute or constant values
+type FieldMappingEntry struct {
+	Name   string            `json:"name"`             // the output Solr field name
+	Source string            `json:"source,omitempty"` // the attribute the values come from
+	Values []string          `json:"values,omitempty"` // constant values
+	When   *MappingCondition `json:"when,omitempty"`   // only applied when the condition is met
+	Dedup  bool              `json:"dedup,omitempty"`  // ignore values already added to this field
+}
+
+// MappingCondition - the condition for applying a mapping entry. The source attribute must be non-empty
+// or, if specified, equal the value. Part conditions select the parts used by part sources and are otherwise
+// met when any part matches
+type MappingCondition struct {
+	Source string `json:"source"`
+	Equals string `json:"equals,omitempty"`
+}
+
+// the item attributes available to the mapping
+var itemAttributes = map[string]func(*TracksysSirsiItem) string{
+	"sirsiId":        func(i *TracksysSirsiItem) string { return i.SirsiId },
+	"pdfServiceRoot": func(i *TracksysSirsiItem) string { return i.PdfServiceRoot },
+	"collection":     func(i *TracksysSirsiItem) string { return i.Collection },
+}
+
+// the part attributes available to the mapping
+var partAttributes = map[string]func(*TracksysPart) []string{
+	"pid":                    func(p *TracksysPart) []string { return []string{p.Pid} },
+	"callNumber":             func(p *TracksysPart) []string { return []string{p.CallNumber} },
+	"barcode":                func(p *TracksysPart) []string { return []string{p.Barcode} },
+	"rsURI":                  func(p *TracksysPart) []string { return []string{p.RsURI} },
+	"rsUses":                 func(p *TracksysPart) []string { return p.RsUses },
+	"rightsWrapperUrl":       func(p *TracksysPart) []string { return []string{p.RightsWrapperUrl} },
+	"rightsWrapperText":      func(p *TracksysPart) []string { return []string{p.RightsWrapperText} },
+	"backendIIIFManifestUrl": func(p *TracksysPart) []string { return []string{p.BackendIIIFManifestUrl} },
+	"thumbnailUrl":           func(p *TracksysPart) []string { return []string{p.ThumbnailUrl} },
+	"pdfServiceRoot":         func(p *TracksysPart) []string { return []string{p.PdfServiceRoot} },
+}
+
+// the attributes calculated by the enrich step rather than taken directly from Tracksys
+var computedAttributes = []string{"policy", "pdfDownloadUrl", "pdfFeature"}
+
+// LoadFieldMapping - load and validate the field mapping file
+func LoadFieldMapping(filename string) (*FieldMapping, error) {
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := FieldMapping{}
+	err = json.Unmarshal(buf, &mapping)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of FieldMapping: %s", err)
+		return nil, err
+	}
+
+	for ix, entry := range mapping.Fields {
+		err = entry.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: field mapping %d (%s): %s", filename, ix, entry.Name, err)
+		}
+	}
+
+	log.Printf("INFO: loaded %d field mappings from %s", len(mapping.Fields), filename)
+	return &mapping, nil
+}
+
+func (entry FieldMappingEntry) validate() error {
+
+	if len(entry.Name) == 0 {
+		return fmt.Errorf("no field name")
+	}
+	if len(entry.Source) == 0 && len(entry.Values) == 0 {
+		return fmt.Errorf("one of source or values is required")
+	}
+	if len(entry.Source) != 0 && len(entry.Values) != 0 {
+		return fmt.Errorf("source and values are mutually exclusive")
+	}
+	if len(entry.Source) != 0 && knownAttribute(entry.Source) == false {
+		return fmt.Errorf("unknown source [%s]", entry.Source)
+	}
+	if entry.When != nil && knownAttribute(entry.When.Source) == false {
+		return fmt.Errorf("unknown condition source [%s]", entry.When.Source)
+	}
+	return nil
+}
+
+func knownAttribute(name string) bool {
+	if strings.HasPrefix(name, partSourcePrefix) == true {
+		_, found := partAttributes[strings.TrimPrefix(name, partSourcePrefix)]
+		return found
+	}
+	if _, found := itemAttributes[name]; found == true {
+		return true
+	}
+	return computedAttribute(name)
+}
+
+func computedAttribute(name string) bool {
+	for _, c := range computedAttributes {
+		if name == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply - generate the mapped fields for the supplied item and computed attributes
+func (fm *FieldMapping) Apply(item *TracksysSirsiItem, computed map[string][]string) []solrdoc.Field {
+
+	doc := solrdoc.NewDocument()
+	appendMappedFields(doc, fm.Fields, item, computed)
+	return doc.Fields
+}
+
+// append the fields generated by the mapping entries to the document
+func appendMappedFields(doc *solrdoc.Document, entries []FieldMappingEntry, item *TracksysSirsiItem, computed map[string][]string) {
+
+	for _, entry := range entries {
+		values, applies := entry.evaluate(item, computed)
+		if applies == false {
+			continue
+		}
+
+		for _, v := range values {
+			if entry.Dedup == true && fieldHasValue(doc, entry.Name, v) == true {
+				continue
+			}
+			doc.Append(entry.Name, v)
+		}
+	}
+}
+
+// evaluate the mapping entry, returns the (non-empty) values and whether the entry applies at all
+func (entry FieldMappingEntry) evaluate(item *TracksysSirsiItem, computed map[string][]string) ([]string, bool) {
+
+	parts := item.Items
+	if entry.When != nil {
+		var met bool
+		met, parts = entry.When.evaluate(item, computed)
+		if met == false {
+			return nil, false
+		}
+	}
+
+	values := entry.Values
+	if len(entry.Source) != 0 {
+		values = sourceValues(entry.Source, item, parts, computed)
+	}
+	return nonEmpty(values), true
+}
+
+// evaluate the condition, returns whether it was met and the parts that meet it
+func (mc *MappingCondition) evaluate(item *TracksysSirsiItem, computed map[string][]string) (bool, []TracksysPart) {
+
+	if strings.HasPrefix(mc.Source, partSourcePrefix) == true {
+		parts := make([]TracksysPart, 0, len(item.Items))
+		for _, p := range item.Items {
+			if mc.matches(sourceValues(mc.Source, item, []TracksysPart{p}, computed)) == true {
+				parts = append(parts, p)
+			}
+		}
+		return len(parts) != 0, parts
+	}
+
+	return mc.matches(sourceValues(mc.Source, item, item.Items, computed)), item.Items
+}
+
+func (mc *MappingCondition) matches(values []string) bool {
+	for _, v := range values {
+		if len(mc.Equals) == 0 && len(v) != 0 {
+			return true
+		}
+		if len(mc.Equals) != 0 && v == mc.Equals {
+			return true
+		}
+	}
+	return false
+}
+
+func sourceValues(source string, item *TracksysSirsiItem, parts []TracksysPart, computed map[string][]string) []string {
+
+	if strings.HasPrefix(source, partSourcePrefix) == true {
+		attribute := partAttributes[strings.TrimPrefix(source, partSourcePrefix)]
+		res := make([]string, 0, len(parts))
+		for ix := range parts {
+			res = append(res, attribute(&parts[ix])...)
+		}
+		return res
+	}
+
+	if attribute, found := itemAttributes[source]; found == true {
+		return []string{attribute(item)}
+	}
+
+	return computed[source]
+}
+
+func fieldHasValue(doc *solrdoc.Document, name string, value string) bool {
+	for _, v := range doc.Get(name) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// end of file
+//
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// the location of the mapping files relative to the package
+var testMappingsDir = "../../mappings"
+
+func testItem() *TracksysSirsiItem {
+	return &TracksysSirsiItem{
+		SirsiId:    "u1",
+		Collection: "Gannon",
+		Items: []TracksysPart{
+			{Pid: "uva-lib:1", CallNumber: "MSS 1", Barcode: "X001", RsUses: []string{"a", "b"}},
+			{Pid: "uva-lib:2", CallNumber: "MSS 2", PdfServiceRoot: "https://pdf"},
+		},
+	}
+}
+
+func TestLoadDefaultFieldMapping(t *testing.T) {
+	_, err := LoadFieldMapping(testMappingsDir + "/tracksys-enrich-fields.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestFieldMappingValidate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		entry FieldMappingEntry
+		valid bool
+	}{
+		{"values", FieldMappingEntry{Name: "f", Values: []string{"v"}}, true},
+		{"item source", FieldMappingEntry{Name: "f", Source: "collection"}, true},
+		{"part source", FieldMappingEntry{Name: "f", Source: "part.pid"}, true},
+		{"computed source", FieldMappingEntry{Name: "f", Source: "policy"}, true},
+		{"no name", FieldMappingEntry{Values: []string{"v"}}, false},
+		{"no source or values", FieldMappingEntry{Name: "f"}, false},
+		{"source and values", FieldMappingEntry{Name: "f", Source: "collection", Values: []string{"v"}}, false},
+		{"unknown source", FieldMappingEntry{Name: "f", Source: "part.unknown"}, false},
+		{"unknown condition", FieldMappingEntry{Name: "f", Values: []string{"v"}, When: &MappingCondition{Source: "unknown"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.entry.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestFieldMappingApply(t *testing.T) {
+
+	computed := map[string][]string{"policy": {"uva"}, "pdfFeature": {}}
+	tests := []struct {
+		name     string
+		entry    FieldMappingEntry
+		expected []string
+	}{
+		{"constant", FieldMappingEntry{Name: "f", Values: []string{"a", "b"}}, []string{"a", "b"}},
+		{"item attribute", FieldMappingEntry{Name: "f", Source: "collection"}, []string{"Gannon"}},
+		{"empty item attribute", FieldMappingEntry{Name: "f", Source: "pdfServiceRoot"}, []string{}},
+		{"part attribute", FieldMappingEntry{Name: "f", Source: "part.callNumber"}, []string{"MSS 1", "MSS 2"}},
+		{"multi-valued part attribute", FieldMappingEntry{Name: "f", Source: "part.rsUses"}, []string{"a", "b"}},
+		{"computed attribute", FieldMappingEntry{Name: "f", Source: "policy"}, []string{"uva"}},
+		{"empty computed attribute", FieldMappingEntry{Name: "f", Source: "pdfFeature"}, []string{}},
+		{"condition met", FieldMappingEntry{Name: "f", Values: []string{"v"}, When: &MappingCondition{Source: "collection", Equals: "Gannon"}}, []string{"v"}},
+		{"condition not met", FieldMappingEntry{Name: "f", Values: []string{"v"}, When: &MappingCondition{Source: "collection", Equals: "Other"}}, []string{}},
+		{"condition on empty", FieldMappingEntry{Name: "f", Values: []string{"v"}, When: &MappingCondition{Source: "pdfServiceRoot"}}, []string{}},
+		{"part condition selects parts", FieldMappingEntry{Name: "f", Source: "part.pid", When: &MappingCondition{Source: "part.barcode"}}, []string{"uva-lib:1"}},
+		{"dedup", FieldMappingEntry{Name: "f", Values: []string{"a", "a", "b"}, Dedup: true}, []string{"a", "b"}},
+		{"no dedup", FieldMappingEntry{Name: "f", Values: []string{"a", "a"}}, []string{"a", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapping := &FieldMapping{Fields: []FieldMappingEntry{tt.entry}}
+			values := make([]string, 0)
+			for _, f := range mapping.Apply(testItem(), computed) {
+				if f.Name != tt.entry.Name {
+					t.Fatalf("unexpected field %s", f.Name)
+				}
+				values = append(values, f.Value)
+			}
+			if reflect.DeepEqual(values, tt.expected) == false {
+				t.Errorf("expected %v, got %v", tt.expected, values)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
@@ -1,45 +1,49 @@
 package main
 
-import (
-	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
-)
-
 // this is our actual implementation
 type rewriteFieldStepImpl struct {
-	rewriteFields map[string]string // the fields to rewrite and their rewritten values
+	rules *RewriteRules // the field rewrite rules
 }
 
 // NewFieldRewriteStep - the factory
-func NewFieldRewriteStep(config *ServiceConfig) PipelineStep {
+func NewFieldRewriteStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
 
 	// mock implementation here if necessary
 
+	err := options.Validate("rules")
+	if err != nil {
+		return nil, err
+	}
+
 	impl := &rewriteFieldStepImpl{}
-	impl.rewriteFields = config.RewriteFields
+	impl.rules, err = LoadRewriteRules(options.Get("rules", config.RewriteRulesFile))
+	if err != nil {
+		return nil, err
+	}
 
-	return impl
+	return impl, nil
 }
 
 func (si *rewriteFieldStepImpl) Name() string {
-	return "Field rewrite"
+	return stepNameFieldRewrite
 }
 
-func (si *rewriteFieldStepImpl) Process(message *awssqs.Message, data interface{}) (bool, interface{}, error) {
+func (si *rewriteFieldStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextTracksys}
+}
 
-	current := string(message.Payload)
+func (si *rewriteFieldStepImpl) Provides() []ContextItem {
+	return []ContextItem{}
+}
 
-	// remove the existing fields
-	for k := range si.rewriteFields {
-		current = RemoveXmlField(current, k)
-	}
+func (si *rewriteFieldStepImpl) Process(ctx *EnrichContext) (bool, error) {
 
-	// then add the rewritten ones
-	for k, v := range si.rewriteFields {
-		current = AppendXmlField(current, k, v)
+	err := si.rules.Apply(ctx)
+	if err != nil {
+		return false, err
 	}
 
-	message.Payload = []byte(current)
-	return true, data, nil
+	return true, nil
 }
 
 //
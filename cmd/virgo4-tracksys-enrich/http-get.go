@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,11 +24,17 @@ func newHttpClient(maxConnections int, timeout int) *http.Client {
 	}
 }
 
-func httpGet(url string, client *http.Client) ([]byte, error) {
+func httpGet(url string, endpoint string, client *http.Client) ([]byte, error) {
+	return httpGetLimited(url, endpoint, client, 0)
+}
+
+// httpGetLimited - as httpGet but fails if the response body is larger than the limit (0 for no limit)
+func httpGetLimited(url string, endpoint string, client *http.Client, limit int64) ([]byte, error) {
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Printf("ERROR: GET %s failed with error (%s)", url, err)
+		httpStatus.WithLabelValues(endpoint, "error").Inc()
 		return nil, err
 	}
 
@@ -37,9 +45,11 @@ func httpGet(url string, client *http.Client) ([]byte, error) {
 		response, err = client.Do(req)
 		duration := time.Since(start)
 		log.Printf("INFO: GET %s (elapsed %d ms)", url, duration.Milliseconds())
+		httpDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
 
 		count++
 		if err != nil {
+			httpStatus.WithLabelValues(endpoint, "error").Inc()
 			if canRetry(err) == false {
 				log.Printf("ERROR: GET %s failed with error (%s)", url, err)
 				return nil, err
@@ -51,12 +61,14 @@ func httpGet(url string, client *http.Client) ([]byte, error) {
 			}
 
 			log.Printf("ERROR: GET %s failed with error, retrying (%s)", url, err)
+			httpRetries.WithLabelValues(endpoint).Inc()
 
 			// sleep for a bit before retrying
 			time.Sleep(retrySleepTime)
 		} else {
 
 			defer response.Body.Close()
+			httpStatus.WithLabelValues(endpoint, strconv.Itoa(response.StatusCode)).Inc()
 
 			if response.StatusCode != http.StatusOK {
 				logLevel := "ERROR"
@@ -70,10 +82,18 @@ func httpGet(url string, client *http.Client) ([]byte, error) {
 
 				return body, fmt.Errorf("request returns HTTP %d", response.StatusCode)
 			} else {
-				body, err := ioutil.ReadAll(response.Body)
+				reader := io.Reader(response.Body)
+				if limit > 0 {
+					reader = io.LimitReader(response.Body, limit+1)
+				}
+				body, err := ioutil.ReadAll(reader)
 				if err != nil {
 					return nil, err
 				}
+				if limit > 0 && int64(len(body)) > limit {
+					log.Printf("ERROR: GET %s response exceeds %d bytes", url, limit)
+					return nil, fmt.Errorf("response exceeds %d bytes", limit)
+				}
 
 				//log.Printf( body )
 				return body, nil
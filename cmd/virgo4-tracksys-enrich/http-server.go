@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NewHttpServer - start the embedded http server that exposes our service endpoints
+func NewHttpServer(config *ServiceConfig) {
+
+	if config.HttpPort == 0 {
+		log.Printf("INFO: http server disabled")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+
+	addr := fmt.Sprintf(":%d", config.HttpPort)
+	log.Printf("INFO: http server listening on %s", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		fatalIfError(err)
+	}()
+}
+
+// the liveness endpoint, if we can respond then we are alive
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// the readiness endpoint, reflects the state of the cache, queue polling and the workers
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+
+	ready, checks := ServiceHealth.Ready()
+	status := http.StatusOK
+	if ready == false {
+		status = http.StatusServiceUnavailable
+	}
+	writeJsonResponse(w, status, checks)
+}
+
+func writeJsonResponse(w http.ResponseWriter, status int, content interface{}) {
+
+	body, err := json.Marshal(content)
+	if err != nil {
+		log.Printf("ERROR: json marshal of http response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a SOLR limitation
+var maxSolrFieldSize = 32765
+
+// the largest manifest we will fetch
+var maxManifestSize = 10 * 1024 * 1024
+
+// the fields we add from the IIIF manifest summary
+var iiifLabelFieldName = "iiif_label_a"
+var iiifPageCountFieldName = "iiif_page_count_a"
+var iiifCanvasLabelFieldName = "iiif_canvas_label_a"
+var iiifRightsFieldName = "iiif_rights_a"
+var iiifMetadataFieldName = "iiif_metadata_a"
+var iiifManifestUrlFieldName = "iiif_manifest_cache_url_a"
+
+// what to do when a manifest cannot be fetched or parsed
+var iiifErrorPolicyWarn = "warn"
+var iiifErrorPolicyFail = "fail"
+
+// IIIFManifest - the parts of a IIIF presentation manifest (version 2 or 3) we summarize
+type IIIFManifest struct {
+	Label             json.RawMessage `json:"label"`
+	License           json.RawMessage `json:"license"`           // version 2
+	Attribution       json.RawMessage `json:"attribution"`       // version 2
+	Rights            json.RawMessage `json:"rights"`            // version 3
+	RequiredStatement *IIIFPair       `json:"requiredStatement"` // version 3
+	Metadata          []IIIFPair      `json:"metadata"`
+	Sequences         []struct {
+		Canvases []IIIFCanvas `json:"canvases"`
+	} `json:"sequences"` // version 2
+	Items []IIIFCanvas `json:"items"` // version 3
+}
+
+// IIIFCanvas - a single canvas (page)
+type IIIFCanvas struct {
+	Label json.RawMessage `json:"label"`
+}
+
+// IIIFPair - a label and value pair
+type IIIFPair struct {
+	Label json.RawMessage `json:"label"`
+	Value json.RawMessage `json:"value"`
+}
+
+// this is our actual implementation
+type iiifManifestStepImpl struct {
+	config      *ServiceConfig    // the service configuration
+	store       ContentCacheStore // the digital content cache
+	maxSize     int               // the maximum total size of the summary fields for the record
+	maxManifest int               // the maximum size of a manifest
+	errorPolicy string            // what to do when a manifest is unavailable
+	httpClient  *http.Client      // our http client connection
+}
+
+// NewIIIFManifestStep - the factory
+func NewIIIFManifestStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
+
+	// mock implementation here if necessary
+
+	err := options.Validate("max_size", "max_manifest_size", "on_error")
+	if err != nil {
+		return nil, err
+	}
+
+	impl := &iiifManifestStepImpl{}
+	impl.config = config
+	impl.store = store
+	impl.maxSize, err = strconv.Atoi(options.Get("max_size", strconv.Itoa(maxSolrFieldSize)))
+	if err != nil || impl.maxSize <= 0 {
+		return nil, fmt.Errorf("invalid max_size option")
+	}
+	impl.maxManifest, err = strconv.Atoi(options.Get("max_manifest_size", strconv.Itoa(maxManifestSize)))
+	if err != nil || impl.maxManifest <= 0 {
+		return nil, fmt.Errorf("invalid max_manifest_size option")
+	}
+	impl.errorPolicy = options.Get("on_error", iiifErrorPolicyWarn)
+	if impl.errorPolicy != iiifErrorPolicyWarn && impl.errorPolicy != iiifErrorPolicyFail {
+		return nil, fmt.Errorf("unsupported on_error option [%s]", impl.errorPolicy)
+	}
+	impl.httpClient = newHttpClient(2, config.ServiceTimeout)
+	return impl, nil
+}
+
+func (si *iiifManifestStepImpl) Name() string {
+	return stepNameIIIFManifest
+}
+
+func (si *iiifManifestStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextTracksys}
+}
+
+func (si *iiifManifestStepImpl) Provides() []ContextItem {
+	return []ContextItem{ContextManifest}
+}
+
+func (si *iiifManifestStepImpl) Process(ctx *EnrichContext) (bool, error) {
+
+	for _, part := range ctx.Tracksys.Items {
+		if len(part.BackendIIIFManifestUrl) == 0 {
+			continue
+		}
+
+		err := si.processManifest(ctx, part)
+		if err != nil {
+			if si.errorPolicy == iiifErrorPolicyFail {
+				return false, err
+			}
+			ctx.Warning(fmt.Sprintf("IIIF manifest for %s unavailable (%s)", part.Pid, err))
+		}
+	}
+
+	return true, nil
+}
+
+func (si *iiifManifestStepImpl) processManifest(ctx *EnrichContext, part TracksysPart) error {
+
+	body, err := httpGetLimited(part.BackendIIIFManifestUrl, endpointIIIFManifest, si.httpClient, int64(si.maxManifest))
+	if err != nil {
+		return err
+	}
+
+	manifest := IIIFManifest{}
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of IIIFManifest: %s", err)
+		return err
+	}
+
+	// the full manifest goes in the digital content cache rather than Solr
+	key := fmt.Sprintf("iiif/%s.json", normalizeId(part.Pid))
+	_, force := ctx.Message.GetAttribute(forceWriteAttributeName)
+	_, err = si.store.WriteIfChanged(key, string(body), force)
+	if err != nil {
+		return err
+	}
+	manifestUrl := fmt.Sprintf("%s/%s/%s", si.config.DigitalContentCacheRoot, si.config.DigitalContentCacheBucket, key)
+	ctx.Manifests = append(ctx.Manifests, manifestUrl)
+
+	// and a compact summary goes in the index
+	si.addSummary(ctx, part.Pid, manifest)
+	ctx.AddField(iiifManifestUrlFieldName, manifestUrl)
+	return nil
+}
+
+// add the manifest summary fields, dropping the least useful parts of the summary when it is too large
+func (si *iiifManifestStepImpl) addSummary(ctx *EnrichContext, pid string, manifest IIIFManifest) {
+
+	canvases := manifest.Items
+	for _, s := range manifest.Sequences {
+		canvases = append(canvases, s.Canvases...)
+	}
+
+	summary := make([][2]string, 0)
+	summary = append(summary, [2]string{iiifLabelFieldName, iiifText(manifest.Label)})
+	summary = append(summary, [2]string{iiifPageCountFieldName, strconv.Itoa(len(canvases))})
+	summary = append(summary, [2]string{iiifRightsFieldName, iiifText(manifest.Rights)})
+	summary = append(summary, [2]string{iiifRightsFieldName, iiifText(manifest.License)})
+	summary = append(summary, [2]string{iiifRightsFieldName, iiifText(manifest.Attribution)})
+	if manifest.RequiredStatement != nil {
+		summary = append(summary, [2]string{iiifRightsFieldName, iiifPairText(*manifest.RequiredStatement)})
+	}
+	for _, m := range manifest.Metadata {
+		summary = append(summary, [2]string{iiifMetadataFieldName, iiifPairText(m)})
+	}
+	for _, c := range canvases {
+		summary = append(summary, [2]string{iiifCanvasLabelFieldName, iiifText(c.Label)})
+	}
+
+	// the size guard, no single value may exceed the Solr limit and the total for the record (across all of
+	// its parts) may not exceed our maximum
+	dropped := make(map[string]int)
+	for _, s := range summary {
+		if len(s[1]) == 0 {
+			continue
+		}
+		if len(s[1]) > maxSolrFieldSize || ctx.ManifestSummarySize+len(s[1]) > si.maxSize {
+			dropped[s[0]]++
+			continue
+		}
+		ctx.ManifestSummarySize += len(s[1])
+		ctx.AddField(s[0], s[1])
+	}
+
+	for name, count := range dropped {
+		ctx.Warning(fmt.Sprintf("IIIF manifest summary for %s exceeds the size limit, dropped %d %s value(s)", pid, count, name))
+	}
+}
+
+// a IIIF text value may be a string, a list of strings, a list of language values or a language map
+func iiifText(raw json.RawMessage) string {
+
+	if len(raw) == 0 {
+		return ""
+	}
+
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return strings.TrimSpace(str)
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		values := make([]string, 0, len(list))
+		for _, l := range list {
+			values = append(values, iiifText(l))
+		}
+		return strings.Join(nonEmpty(values), "; ")
+	}
+
+	var value struct {
+		Value json.RawMessage `json:"@value"`
+	}
+	if json.Unmarshal(raw, &value) == nil && len(value.Value) != 0 {
+		return iiifText(value.Value)
+	}
+
+	var languages map[string][]string
+	if json.Unmarshal(raw, &languages) == nil {
+		// prefer english, then anything without a language, then whatever we have
+		for _, lang := range []string{"en", "none"} {
+			if values, found := languages[lang]; found == true {
+				return strings.Join(nonEmpty(values), "; ")
+			}
+		}
+		langs := make([]string, 0, len(languages))
+		for lang := range languages {
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+		if len(langs) != 0 {
+			return strings.Join(nonEmpty(languages[langs[0]]), "; ")
+		}
+	}
+
+	return ""
+}
+
+func iiifPairText(pair IIIFPair) string {
+	label := iiifText(pair.Label)
+	value := iiifText(pair.Value)
+	if len(label) == 0 {
+		return value
+	}
+	if len(value) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", label, value)
+}
+
+//
+// end of file
+//
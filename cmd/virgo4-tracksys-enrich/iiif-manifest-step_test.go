@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// the configuration used by the tests that need the digital content cache
+func testConfig() *ServiceConfig {
+	return &ServiceConfig{
+		Mode:                      "sirsi",
+		ContentCacheStore:         contentCacheStoreMemory,
+		DigitalContentCacheRoot:   "https://cache",
+		DigitalContentCacheBucket: "bucket",
+		ServiceEndpoint:           "https://tracksys",
+		CacheDetailsApi:           "details",
+		PidDetailsApi:             "pid",
+		OcrServiceRoot:            "https://ocr",
+		OembedRoot:                "https://oembed",
+		ServiceTimeout:            5,
+		CacheWithdrawnPolicy:      cacheWithdrawnPolicyKeep,
+	}
+}
+
+func TestIIIFText(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{"empty", ``, ""},
+		{"string", `" a label "`, "a label"},
+		{"list", `["one", "", "two"]`, "one; two"},
+		{"language value", `{"@value": "value", "@language": "en"}`, "value"},
+		{"language values", `[{"@value": "one"}, {"@value": "two"}]`, "one; two"},
+		{"language map english", `{"fr": ["le"], "en": ["the"]}`, "the"},
+		{"language map none", `{"fr": ["le"], "none": ["x"]}`, "x"},
+		{"language map other", `{"fr": ["le"], "de": ["der"]}`, "der"},
+		{"number", `42`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := iiifText(json.RawMessage(tt.raw))
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestIIIFManifestSizeGuard(t *testing.T) {
+
+	label := strings.Repeat("x", 100)
+	manifest := fmt.Sprintf(`{"label": "%s", "sequences": [{"canvases": [{"label": "%s"}, {"label": "%s"}]}]}`, label, label, label)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			fmt.Fprint(w, strings.Repeat(" ", 2048), manifest)
+			return
+		}
+		fmt.Fprint(w, manifest)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		options  StepOptions
+		parts    int
+		path     string
+		values   int // the number of summary values of at least the label size
+		warnings int
+	}{
+		{"within the limit", nil, 2, "/m", 6, 0},
+		{"limit applies across parts", StepOptions{"max_size": "450"}, 3, "/m", 4, 3},
+		{"manifest too large", StepOptions{"max_manifest_size": "1024"}, 1, "/large", 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _ := NewContentCacheStore(testConfig())
+			step, err := NewIIIFManifestStep(testConfig(), store, tt.options)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			ctx := NewEnrichContext("sirsi", testMessage("u1", `<add><doc><field name="id">u1</field></doc></add>`))
+			ctx.Tracksys = &TracksysSirsiItem{SirsiId: "u1"}
+			for ix := 0; ix < tt.parts; ix++ {
+				ctx.Tracksys.Items = append(ctx.Tracksys.Items, TracksysPart{Pid: fmt.Sprintf("uva-lib:%d", ix), BackendIIIFManifestUrl: server.URL + tt.path})
+			}
+
+			_, err = step.Process(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			labels, _ := ctx.Field(iiifLabelFieldName)
+			canvases, _ := ctx.Field(iiifCanvasLabelFieldName)
+			if len(labels)+len(canvases) != tt.values {
+				t.Errorf("expected %d summary values, got %d", tt.values, len(labels)+len(canvases))
+			}
+			if len(ctx.Warnings) != tt.warnings {
+				t.Errorf("expected %d warnings, got %v", tt.warnings, ctx.Warnings)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
@@ -3,6 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
@@ -11,11 +14,25 @@ import (
 // main entry point
 func main() {
 
+	// the cache maintenance commands run instead of the service and only need the cache configuration
+	if len(os.Args) > 1 && (os.Args[1] == migrateCacheCommand || os.Args[1] == sweepCacheCommand) {
+		cacheCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	log.Printf("===> %s service staring up (version: %s) <===", os.Args[0], Version())
 
 	// Get config params and use them to init service context. Any issues are fatal
 	cfg := LoadConfiguration()
 
+	// the digital content cache store, shared by everything that reads or writes the cache
+	store, err := NewContentCacheStore(cfg)
+	fatalIfError(err)
+
+	// create the health checker and start the http server so metrics and health are available as early as possible
+	NewHealthChecker(cfg)
+	NewHttpServer(cfg)
+
 	// load our AWS_SQS helper object
 	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
 	fatalIfError(err)
@@ -27,22 +44,124 @@ func main() {
 	outQueueHandle, err := aws.QueueHandle(cfg.OutQueueName)
 	fatalIfError(err)
 
+	// the dead letter routing for records that fail enrichment
+	deadLetter, err := NewDeadLetter(cfg, aws)
+	fatalIfError(err)
+
+	// create a pipeline for each worker, this ensures the pipeline definition is valid before we go any further
+	pipelines := make([]Pipeline, 0, cfg.Workers)
+	for w := 1; w <= cfg.Workers; w++ {
+		pipeline, err := NewEnrichPipeline(cfg, store)
+		fatalIfError(err)
+		pipelines = append(pipelines, pipeline)
+	}
+
 	// load the Tracksis ID cache (so we only lookup items in tracksys that we know already exist)
-	err = NewCacheLoader(cfg)
+	err = NewCacheLoader(cfg, aws, store)
 	fatalIfError(err)
 
 	// create the record channel
 	inboundMessageChan := make(chan awssqs.Message, cfg.WorkerQueueSize)
 
+	// message accounting shared by the poller and the workers
+	stats := &MessageStats{}
+
 	// start workers here
+	var workers sync.WaitGroup
 	for w := 1; w <= cfg.Workers; w++ {
-		go worker(w, cfg, aws, inboundMessageChan, inQueueHandle, outQueueHandle)
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			worker(id, cfg, aws, pipelines[id-1], inboundMessageChan, inQueueHandle, outQueueHandle, deadLetter, stats)
+		}(w)
+	}
+
+	// start the poller, it closes the record channel once it has been told to stop
+	stopPolling := make(chan struct{})
+	pollerDone := make(chan struct{})
+	go func() {
+		defer close(pollerDone)
+		poller(cfg, aws, inQueueHandle, inboundMessageChan, stopPolling, stats)
+	}()
+
+	// wait for a termination signal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Printf("INFO: received %s, stopping message polling and draining workers (timeout %d seconds)", sig, cfg.ShutdownTimeout)
+	processedAtSignal := stats.Processed()
+	ServiceHealth.ShuttingDown()
+	close(stopPolling)
+
+	// wait for the poller to stop and the workers to drain
+	drained := make(chan struct{})
+	go func() {
+		<-pollerDone
+		workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Printf("INFO: all workers drained")
+	case <-time.After(time.Duration(cfg.ShutdownTimeout) * time.Second):
+		log.Printf("WARNING: shutdown timeout expired before all workers drained")
+	case sig = <-signals:
+		log.Printf("WARNING: received %s during shutdown, not waiting for workers", sig)
 	}
 
+	// abandoned messages will become visible on the inbound queue again once their visibility timeout expires
+	flushed := stats.Processed() - processedAtSignal
+	abandoned := stats.Received() - stats.Processed()
+	log.Printf("INFO: shutdown complete, %d message(s) flushed, %d message(s) abandoned", flushed, abandoned)
+	log.Printf("===> %s service exiting <===", os.Args[0])
+}
+
+// run a cache maintenance command, these only need the cache configuration (and Tracksys to sweep)
+func cacheCommand(command string, args []string) {
+
+	log.Printf("===> %s %s (version: %s) <===", os.Args[0], command, Version())
+	cfg := LoadCacheCommandConfiguration(command == sweepCacheCommand)
+	store, err := NewContentCacheStore(cfg)
+	fatalIfError(err)
+
+	// migrate the metadata cache entries to the current schema version
+	if command == migrateCacheCommand {
+		err = migrateCache(cfg, store, args)
+	}
+
+	// sweep the metadata cache for entries of items no longer in Tracksys
+	if command == sweepCacheCommand {
+		err = sweepCache(cfg, store, args)
+	}
+	fatalIfError(err)
+}
+
+// poll the inbound queue and feed the workers until told to stop
+func poller(cfg *ServiceConfig, aws awssqs.AWS_SQS, inQueue awssqs.QueueHandle, outbound chan<- awssqs.Message, stop <-chan struct{}, stats *MessageStats) {
+
+	// the workers exit once the channel is closed and drained
+	defer close(outbound)
+
 	for {
 
+		// have we been asked to stop
+		select {
+		case <-stop:
+			log.Printf("INFO: message polling stopped")
+			return
+		default:
+		}
+
+		// if the cache has expired, we do not consume any more messages until it recovers
+		if TracksysIdCache.Suspended() == true {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
 		// wait for a batch of messages
-		messages, err := aws.BatchMessageGet(inQueueHandle, awssqs.MAX_SQS_BLOCK_COUNT, time.Duration(cfg.PollTimeOut)*time.Second)
+		messages, err := aws.BatchMessageGet(inQueue, awssqs.MAX_SQS_BLOCK_COUNT, time.Duration(cfg.PollTimeOut)*time.Second)
 		if err != nil {
 			log.Printf("ERROR: during message get (%s), sleeping and retrying", err.Error())
 
@@ -53,14 +172,17 @@ func main() {
 			continue
 		}
 
+		ServiceHealth.PollSucceeded()
+
 		// did we receive any?
 		sz := len(messages)
 		if sz != 0 {
 
 			//log.Printf( "Received %d messages", sz )
 
+			stats.AddReceived(sz)
 			for _, m := range messages {
-				inboundMessageChan <- m
+				outbound <- m
 			}
 
 		} else {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// the current version of the metadata cache entry schema. Increment it whenever a change to the entries
+// could affect downstream consumers (and update the migration accordingly)
+//
+//	1 - schema_version added
+//	2 - generated_at, service_version and sources added
+//	    (migrated_at is only present on entries migrated from an earlier version)
+var metadataCacheSchemaVersion = 2
+
+// CacheEntryHeader - the versioning information common to all the metadata cache entries
+type CacheEntryHeader struct {
+	SchemaVersion  int      `json:"schema_version"`
+	GeneratedAt    string   `json:"generated_at"`          // when the entry was generated (RFC3339)
+	ServiceVersion string   `json:"service_version"`       // the version of the service that generated it
+	Sources        []string `json:"sources,omitempty"`     // the Tracksys urls the entry is derived from
+	MigratedAt     string   `json:"migrated_at,omitempty"` // when the entry was last migrated to a newer schema (RFC3339)
+}
+
+// MultiPidCacheEntry - the metadata cache entry for a Sirsi item with one or more parts
+type MultiPidCacheEntry struct {
+	CacheEntryHeader
+	Id    string              `json:"id"`
+	Parts []MultiPidCachePart `json:"parts"`
+}
+
+// MultiPidCachePart - a single part of a multi PID cache entry
+type MultiPidCachePart struct {
+	IIIFManifestUrl string             `json:"iiif_manifest_url"`
+	OembedUrl       string             `json:"oembed_url"`
+	Label           string             `json:"label"`
+	Ocr             *CacheServiceEntry `json:"ocr,omitempty"`
+	Pdf             *CacheServiceEntry `json:"pdf,omitempty"`
+	Pid             string             `json:"pid"`
+	ThumbnailUrl    string             `json:"thumbnail_url"`
+}
+
+// SinglePidCacheEntry - the metadata cache entry for a single PID item
+type SinglePidCacheEntry struct {
+	CacheEntryHeader
+	Id              string             `json:"id"`
+	IIIFManifestUrl string             `json:"iiif_manifest_url"`
+	OembedUrl       string             `json:"oembed_url"`
+	Pdf             *CacheServiceEntry `json:"pdf,omitempty"`
+	ThumbnailUrl    string             `json:"thumbnail_url"`
+}
+
+// CacheServiceEntry - the urls of a derivative service (OCR, PDF)
+type CacheServiceEntry struct {
+	Urls CacheServiceUrls `json:"urls"`
+}
+
+// CacheServiceUrls - the operations supported by a derivative service
+type CacheServiceUrls struct {
+	Delete   string `json:"delete"`
+	Download string `json:"download"`
+	Generate string `json:"generate"`
+	Status   string `json:"status"`
+}
+
+// NewCacheEntryHeader - the header for an entry generated now from the supplied sources
+func NewCacheEntryHeader(sources []string) CacheEntryHeader {
+	return CacheEntryHeader{
+		SchemaVersion:  metadataCacheSchemaVersion,
+		GeneratedAt:    time.Now().UTC().Format(time.RFC3339),
+		ServiceVersion: Version(),
+		Sources:        sources,
+	}
+}
+
+// NewMultiPidCacheEntry - create the cache entry from the template data
+func NewMultiPidCacheEntry(mc MetadataCache) *MultiPidCacheEntry {
+
+	entry := &MultiPidCacheEntry{CacheEntryHeader: mc.Header, Id: mc.Id}
+	entry.Parts = make([]MultiPidCachePart, 0, len(mc.Parts))
+	for _, p := range mc.Parts {
+		entry.Parts = append(entry.Parts, MultiPidCachePart{
+			IIIFManifestUrl: p.ManifestUrl,
+			OembedUrl:       p.OembedUrl,
+			Label:           p.Label,
+			Ocr:             newCacheServiceEntry(p.OcrUrl, "text"),
+			Pdf:             newCacheServiceEntry(p.PdfUrl, "download"),
+			Pid:             p.Pid,
+			ThumbnailUrl:    p.ThumbUrl,
+		})
+	}
+	return entry
+}
+
+// NewSinglePidCacheEntry - create the cache entry from the template data
+func NewSinglePidCacheEntry(mp MetadataPart) *SinglePidCacheEntry {
+
+	return &SinglePidCacheEntry{
+		CacheEntryHeader: mp.Header,
+		Id:               mp.Pid,
+		IIIFManifestUrl:  mp.ManifestUrl,
+		OembedUrl:        mp.OembedUrl,
+		Pdf:              newCacheServiceEntry(mp.PdfUrl, "download"),
+		ThumbnailUrl:     mp.ThumbUrl,
+	}
+}
+
+// the service urls for the service root, nil if there is no service
+func newCacheServiceEntry(root string, download string) *CacheServiceEntry {
+
+	if len(root) == 0 {
+		return nil
+	}
+	return &CacheServiceEntry{Urls: CacheServiceUrls{
+		Delete:   fmt.Sprintf("%s/delete", root),
+		Download: fmt.Sprintf("%s/%s", root, download),
+		Generate: root,
+		Status:   fmt.Sprintf("%s/status", root),
+	}}
+}
+
+// Validate - ensure the entry is usable, every part must have a PID
+func (entry *MultiPidCacheEntry) Validate() error {
+
+	if len(entry.Id) == 0 {
+		return fmt.Errorf("metadata cache entry has no id")
+	}
+	// an item without parts has an empty list of parts (the historical behavior)
+	if entry.Parts == nil {
+		entry.Parts = make([]MultiPidCachePart, 0)
+	}
+	for ix, p := range entry.Parts {
+		if len(p.Pid) == 0 {
+			return fmt.Errorf("metadata cache entry %s part %d has no pid", entry.Id, ix)
+		}
+	}
+	return nil
+}
+
+// Validate - ensure the entry is usable
+func (entry *SinglePidCacheEntry) Validate() error {
+
+	if len(entry.Id) == 0 {
+		return fmt.Errorf("metadata cache entry has no id")
+	}
+	return nil
+}
+
+// the Tracksys urls a cache entry is derived from, the item details and (for Sirsi items) the details of
+// each PID
+func cacheEntrySources(config *ServiceConfig, id string, pids []string) []string {
+
+	sources := []string{fmt.Sprintf("%s/%s/%s", config.ServiceEndpoint, config.CacheDetailsApi, id)}
+	if config.Mode == "sirsi" {
+		for _, pid := range pids {
+			sources = append(sources, fmt.Sprintf("%s/%s/%s", config.ServiceEndpoint, config.PidDetailsApi, pid))
+		}
+	}
+	return sources
+}
+
+// encode the entry
+func encodeCacheEntry(entry interface{}) (string, error) {
+
+	buf, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCacheEntryEncoding(t *testing.T) {
+
+	labels := []string{
+		`plain`,
+		`MSS "quoted" 1`,
+		`MSS 1\2`,
+		`ends with a backslash \`,
+		"tab\tand newline\n",
+		`<html> & "both" \"escaped\"`,
+	}
+
+	for _, label := range labels {
+		mc := MetadataCache{Header: NewCacheEntryHeader(nil), Id: "u1", Parts: []MetadataPart{{Pid: "uva-lib:1", Label: label}}}
+		content, err := encodeCacheEntry(NewMultiPidCacheEntry(mc))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if json.Valid([]byte(content)) == false {
+			t.Fatalf("invalid json for label %q: %s", label, content)
+		}
+
+		decoded := MultiPidCacheEntry{}
+		err = json.Unmarshal([]byte(content), &decoded)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if decoded.Parts[0].Label != label {
+			t.Errorf("expected label %q, got %q", label, decoded.Parts[0].Label)
+		}
+
+		mp := MetadataPart{Header: NewCacheEntryHeader(nil), Pid: "uva-lib:1", Label: label, ThumbUrl: label}
+		content, err = encodeCacheEntry(NewSinglePidCacheEntry(mp))
+		if err != nil || json.Valid([]byte(content)) == false {
+			t.Fatalf("invalid single PID entry for label %q: %s (%v)", label, content, err)
+		}
+	}
+}
+
+func TestMultiPidCacheEntryValidate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		entry MultiPidCacheEntry
+		valid bool
+	}{
+		{"parts", MultiPidCacheEntry{Id: "u1", Parts: []MultiPidCachePart{{Pid: "p1"}}}, true},
+		{"no parts", MultiPidCacheEntry{Id: "u1"}, true},
+		{"no id", MultiPidCacheEntry{Parts: []MultiPidCachePart{{Pid: "p1"}}}, false},
+		{"part without pid", MultiPidCacheEntry{Id: "u1", Parts: []MultiPidCachePart{{Label: "l"}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.entry.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+
+	// items without parts still get an (empty) list of parts
+	entry := NewMultiPidCacheEntry(MetadataCache{Id: "u1"})
+	content, err := encodeCacheEntry(entry)
+	if err != nil || entry.Validate() != nil || strings.Contains(content, `"parts": []`) == false {
+		t.Errorf("expected an empty parts list, got %s (%v)", content, err)
+	}
+}
+
+//
+// end of file
+//
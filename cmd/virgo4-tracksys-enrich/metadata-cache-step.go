@@ -2,20 +2,22 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
 	"text/template"
 )
 
-// MetadataCache - the structure we will template for the metadata cache entry
+// MetadataCache - the data for a multi PID metadata cache entry (and any override template)
 type MetadataCache struct {
-	Id    string
-	Parts []MetadataPart
+	Header CacheEntryHeader
+	Id     string
+	Parts  []MetadataPart
 }
 
-// MetadataPart - the structure we will template for the metadata cache entry
+// MetadataPart - the data for a single PID metadata cache entry or a part of a multi PID one
 type MetadataPart struct {
+	Header      CacheEntryHeader // only for single PID entries
 	ManifestUrl string
 	Label       string
 	Pid         string
@@ -27,116 +29,184 @@ type MetadataPart struct {
 
 // this is our actual implementation
 type metadataCacheStepImpl struct {
-	config  *ServiceConfig     // the service configuration
-	s3proxy *S3Proxy           // our S3 abstraction
-	tmpl    *template.Template // our pre-rendered template
+	config *ServiceConfig     // the service configuration
+	store  ContentCacheStore  // the digital content cache
+	tmpl   *template.Template // the override template, nil to use the typed entries
+	rules  *CollectionRules   // the collection specific rules
 }
 
 // the field name in the SolrDoc
 var metadataCacheFieldName = "digital_content_service_url_e_stored"
 
+// the cache content is normally only written when it changes, this attribute forces it to be written anyway
+var forceWriteAttributeName = "force-write"
+
 // NewMetaDataCacheStep - the factory
-func NewMetaDataCacheStep(config *ServiceConfig) PipelineStep {
+func NewMetaDataCacheStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
 
 	// mock implementation here if necessary
 
+	err := options.Validate("template")
+	if err != nil {
+		return nil, err
+	}
+
 	impl := &metadataCacheStepImpl{}
 	impl.config = config
-	impl.s3proxy = NewS3Proxy(config)
-	if config.Mode == "sirsi" {
-		impl.tmpl = template.Must(template.ParseFiles("templates/multi-pid-cache-entry.json"))
-	} else {
-		impl.tmpl = template.Must(template.ParseFiles("templates/single-pid-cache-entry.json"))
+	impl.store = store
+	templateFile := options.Get("template", "")
+	if len(templateFile) != 0 {
+		impl.tmpl, err = template.ParseFiles(templateFile)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return impl
+	impl.rules, err = NewCollectionRules(config)
+	if err != nil {
+		return nil, err
+	}
+	return impl, nil
 }
 
 func (si *metadataCacheStepImpl) Name() string {
-	return "Metadata cache"
+	return stepNameMetadataCache
 }
 
-func (si *metadataCacheStepImpl) Process(message *awssqs.Message, data interface{}) (bool, interface{}, error) {
+func (si *metadataCacheStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextTracksys}
+}
 
-	tracksysData, ok := data.(TracksysSirsiItem)
-	if ok == false {
-		log.Printf("ERROR: failed to type assert into known payload")
-		return false, data, ErrorTypeAssertion
-	}
+func (si *metadataCacheStepImpl) Provides() []ContextItem {
+	return []ContextItem{ContextCacheUrl}
+}
 
-	key, err := si.createMetadataCache(tracksysData, message)
+func (si *metadataCacheStepImpl) Process(ctx *EnrichContext) (bool, error) {
+
+	_, force := ctx.Message.GetAttribute(forceWriteAttributeName)
+	key, err := si.createMetadataCache(*ctx.Tracksys, force)
 	if err != nil {
-		return false, data, err
+		return false, err
 	}
 
 	// if we were successful creating the metadata cache, include it's url in the SolrDoc
 
-	current := string(message.Payload)
 	metadataUrl := fmt.Sprintf("%s/%s/%s",
 		si.config.DigitalContentCacheRoot,
 		si.config.DigitalContentCacheBucket,
 		key)
 	//log.Printf("METADATA URL: %s", metadataUrl)
-	current = AppendXmlField(current, metadataCacheFieldName, metadataUrl)
-	message.Payload = []byte(current)
+	ctx.AddField(metadataCacheFieldName, metadataUrl)
+	ctx.CacheUrl = metadataUrl
 
-	return true, data, nil
+	return true, nil
 }
 
-func (si *metadataCacheStepImpl) createMetadataCache(tracksysDetails TracksysSirsiItem, message *awssqs.Message) (string, error) {
+func (si *metadataCacheStepImpl) createMetadataCache(tracksysDetails TracksysSirsiItem, force bool) (string, error) {
 
 	var err error
 	var metadata string
+	var hash string
 	var key string
 	if si.config.Mode == "sirsi" {
-		key = tracksysDetails.SirsiId
-		metadata, err = si.createMultiPidMetadataContent(tracksysDetails)
+		key = metadataCacheKey(si.config, tracksysDetails.SirsiId)
+		metadata, hash, err = si.createMultiPidMetadataContent(tracksysDetails)
 	} else {
-		key = normalizeId(tracksysDetails.Items[0].Pid)
-		metadata, err = si.createSinglePidMetadataContent(tracksysDetails)
+		key = metadataCacheKey(si.config, tracksysDetails.Items[0].Pid)
+		metadata, hash, err = si.createSinglePidMetadataContent(tracksysDetails)
 	}
 
 	if err != nil {
 		return "", err
 	}
+	log.Printf("INFO: cache metadata generated for %s", key)
 
-	err = si.s3proxy.WriteToCache(key, metadata)
+	_, err = si.store.WriteWithHash(key, metadata, hash, force)
 	if err != nil {
 		return "", err
 	}
 	return key, nil
 }
 
-func (si *metadataCacheStepImpl) createMultiPidMetadataContent(tracksysDetails TracksysSirsiItem) (string, error) {
+func (si *metadataCacheStepImpl) createMultiPidMetadataContent(tracksysDetails TracksysSirsiItem) (string, string, error) {
 
-	// build the dataset for the template generation
+	// build the dataset for the cache entry
 	td := si.buildMultiPidTemplateData(tracksysDetails)
 
-	// render the template
-	var outBuffer bytes.Buffer
-	err := si.tmpl.Execute(&outBuffer, td)
+	return generateContent(&td.Header, func() (string, error) {
+		if si.tmpl != nil {
+			return si.renderTemplate(td.Id, td)
+		}
+		entry := NewMultiPidCacheEntry(td)
+		err := entry.Validate()
+		if err != nil {
+			log.Printf("ERROR: invalid cache metadata for %s: %s", td.Id, err.Error())
+			return "", err
+		}
+		return encodeCacheEntry(entry)
+	})
+}
+
+func (si *metadataCacheStepImpl) createSinglePidMetadataContent(tracksysDetails TracksysSirsiItem) (string, string, error) {
+
+	// build the dataset for the cache entry
+	td := si.buildSinglePidTemplateData(tracksysDetails)
+
+	return generateContent(&td.Header, func() (string, error) {
+		if si.tmpl != nil {
+			return si.renderTemplate(td.Pid, td)
+		}
+		entry := NewSinglePidCacheEntry(td)
+		err := entry.Validate()
+		if err != nil {
+			log.Printf("ERROR: invalid cache metadata for %s: %s", td.Pid, err.Error())
+			return "", err
+		}
+		return encodeCacheEntry(entry)
+	})
+}
+
+// generate the content and its hash
+func generateContent(header *CacheEntryHeader, generate func() (string, error)) (string, string, error) {
+
+	hash, err := stableContentHash(header, generate)
 	if err != nil {
-		log.Printf("ERROR: unable to render cache metadata for %s: %s", td.Id, err.Error())
-		return "", err
+		return "", "", err
 	}
-	log.Printf("INFO: cache metadata generated for %s", td.Id)
-	//log.Printf(outBuffer.String())
 
-	return outBuffer.String(), nil
+	content, err := generate()
+	if err != nil {
+		return "", "", err
+	}
+	return content, hash, nil
 }
 
-func (si *metadataCacheStepImpl) createSinglePidMetadataContent(tracksysDetails TracksysSirsiItem) (string, error) {
+// the hash of the generated content excluding the header fields that describe how and when it was generated
+// rather than the content itself, so we can tell when the content has changed
+func stableContentHash(header *CacheEntryHeader, generate func() (string, error)) (string, error) {
 
-	// build the dataset for the template generation
-	td := si.buildSinglePidTemplateData(tracksysDetails)
+	saved := *header
+	header.GeneratedAt, header.ServiceVersion, header.Sources, header.MigratedAt = "", "", nil, ""
+	stable, err := generate()
+	*header = saved
+	if err != nil {
+		return "", err
+	}
+	return contentHash(stable), nil
+}
+
+// render the override template, the result must still be valid json
+func (si *metadataCacheStepImpl) renderTemplate(id string, data interface{}) (string, error) {
 
-	// render the template
 	var outBuffer bytes.Buffer
-	err := si.tmpl.Execute(&outBuffer, td)
+	err := si.tmpl.Execute(&outBuffer, data)
 	if err != nil {
-		log.Printf("ERROR: unable to render cache metadata for %s: %s", td.Pid, err.Error())
+		log.Printf("ERROR: unable to render cache metadata for %s: %s", id, err.Error())
 		return "", err
 	}
-	log.Printf("INFO: cache metadata generated for %s", td.Pid)
+	if json.Valid(outBuffer.Bytes()) == false {
+		log.Printf("ERROR: rendered cache metadata for %s is not valid json", id)
+		return "", fmt.Errorf("rendered cache metadata for %s is not valid json", id)
+	}
 	//log.Printf(outBuffer.String())
 
 	return outBuffer.String(), nil
@@ -147,6 +217,7 @@ func (si *metadataCacheStepImpl) buildMultiPidTemplateData(tracksysDetails Track
 	mc := MetadataCache{}
 	parts := make([]MetadataPart, 0)
 	mc.Id = tracksysDetails.SirsiId
+	mc.Header = NewCacheEntryHeader(cacheEntrySources(si.config, tracksysDetails.SirsiId, itemPids(tracksysDetails)))
 	for _, item := range tracksysDetails.Items {
 		part := MetadataPart{}
 
@@ -154,11 +225,13 @@ func (si *metadataCacheStepImpl) buildMultiPidTemplateData(tracksysDetails Track
 		part.Label = item.CallNumber
 		part.Pid = item.Pid
 		part.ThumbUrl = item.ThumbnailUrl
-		if item.OcrCandidate == true {
+		if item.OcrCandidate == true && si.rules.CacheSuppressed(&tracksysDetails, cacheFeatureOcr) == false {
 			log.Printf("INFO: PID %s is an OCR candidate", item.Pid)
 			part.OcrUrl = fmt.Sprintf("%s/%s", si.config.OcrServiceRoot, item.Pid)
 		}
-		part.PdfUrl = fmt.Sprintf("%s/%s", tracksysDetails.PdfServiceRoot, item.Pid)
+		if si.rules.CacheSuppressed(&tracksysDetails, cacheFeaturePdf) == false {
+			part.PdfUrl = fmt.Sprintf("%s/%s", tracksysDetails.PdfServiceRoot, item.Pid)
+		}
 		part.OembedUrl = fmt.Sprintf("%s/%s", si.config.OembedRoot, item.Pid)
 
 		parts = append(parts, part)
@@ -171,15 +244,27 @@ func (si *metadataCacheStepImpl) buildSinglePidTemplateData(tracksysDetails Trac
 
 	mp := MetadataPart{}
 	mp.Pid = tracksysDetails.Items[0].Pid
+	mp.Header = NewCacheEntryHeader(cacheEntrySources(si.config, mp.Pid, nil))
 	mp.ManifestUrl = tracksysDetails.Items[0].BackendIIIFManifestUrl
 	mp.Label = tracksysDetails.Items[0].CallNumber
 	mp.Pid = tracksysDetails.Items[0].Pid
 	mp.ThumbUrl = tracksysDetails.Items[0].ThumbnailUrl
-	mp.PdfUrl = fmt.Sprintf("%s/%s", tracksysDetails.Items[0].PdfServiceRoot, mp.Pid)
+	if si.rules.CacheSuppressed(&tracksysDetails, cacheFeaturePdf) == false {
+		mp.PdfUrl = fmt.Sprintf("%s/%s", tracksysDetails.Items[0].PdfServiceRoot, mp.Pid)
+	}
 	mp.OembedUrl = fmt.Sprintf("%s/%s", si.config.OembedRoot, mp.Pid)
 	return mp
 }
 
+// the PIDs of the item parts
+func itemPids(tracksysDetails TracksysSirsiItem) []string {
+	pids := make([]string, 0, len(tracksysDetails.Items))
+	for _, i := range tracksysDetails.Items {
+		pids = append(pids, i.Pid)
+	}
+	return pids
+}
+
 //
 // end of file
 //
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"text/template"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestMetadataCacheStep(t *testing.T) {
+
+	rules, err := LoadCollectionRules("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	item := TracksysSirsiItem{SirsiId: "u1", PdfServiceRoot: "https://pdf", Items: []TracksysPart{
+		{Pid: "uva-lib:1", CallNumber: "MSS 1", BackendIIIFManifestUrl: "https://iiif/uva-lib:1", OcrCandidate: true},
+		{Pid: "uva-lib:2", CallNumber: "MSS 2"},
+	}}
+
+	tests := []struct {
+		name      string
+		mode      string
+		id        string
+		key       string
+		changed   bool // the item changes before the second run
+		force     bool // the second run forces the write
+		rewritten bool // is the cache entry written by the second run
+	}{
+		{"unchanged", "sirsi", "u1", "u1", false, false, false},
+		{"changed", "sirsi", "u1", "u1", true, false, true},
+		{"forced", "sirsi", "u1", "u1", false, true, true},
+		{"single pid", "tracksys", "uva-lib:1", "uva-lib-1", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.Mode = tt.mode
+			store := &contentCacheStoreImpl{backend: newMemoryContentCache()}
+			step := &metadataCacheStepImpl{config: config, store: store, rules: rules}
+
+			// process the item twice, marking the entry in the store in between so we can tell if it is rewritten
+			details := item
+			for run := 0; run < 2; run++ {
+				message := testMessage(tt.id, `<add><doc><field name="id">`+tt.id+`</field></doc></add>`)
+				if run == 1 && tt.force == true {
+					message.Attribs = append(message.Attribs, awssqs.Attribute{Name: forceWriteAttributeName, Value: "true"})
+				}
+				ctx := NewEnrichContext(tt.mode, message)
+				ctx.Tracksys = &details
+
+				_, err := step.Process(ctx)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				expected := "https://cache/bucket/" + tt.key
+				values, _ := ctx.Field(metadataCacheFieldName)
+				if len(values) != 1 || values[0] != expected || ctx.CacheUrl != expected {
+					t.Errorf("expected %s, got %v (%s)", expected, values, ctx.CacheUrl)
+				}
+
+				if run == 0 {
+					buf, err := store.Read(tt.key)
+					if err != nil || json.Valid(buf) == false {
+						t.Fatalf("expected a valid cache entry, got %s (%v)", string(buf), err)
+					}
+					// keep the hash so an unchanged entry is not rewritten
+					hash, _ := store.backend.hash(tt.key)
+					_ = store.backend.put(tt.key, []byte("first"), hash)
+					if tt.changed == true {
+						details.Items = details.Items[:1]
+					}
+				}
+			}
+
+			buf, _ := store.Read(tt.key)
+			if (string(buf) != "first") != tt.rewritten {
+				t.Errorf("expected rewritten %t, got %s", tt.rewritten, string(buf))
+			}
+		})
+	}
+}
+
+// the override templates must carry the same versioning header as the typed entries
+func TestMetadataCacheTemplates(t *testing.T) {
+
+	rules, err := LoadCollectionRules("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	item := TracksysSirsiItem{SirsiId: "u1", PdfServiceRoot: "https://pdf", Items: []TracksysPart{
+		{Pid: "uva-lib:1", CallNumber: "MSS 1", BackendIIIFManifestUrl: "https://iiif/uva-lib:1", PdfServiceRoot: "https://pdf"},
+		{Pid: "uva-lib:2", CallNumber: "MSS 2"},
+	}}
+
+	tests := []struct {
+		name     string
+		template string
+		single   bool
+	}{
+		{"multi pid", "../../templates/multi-pid-cache-entry.json", false},
+		{"single pid", "../../templates/single-pid-cache-entry.json", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.ParseFiles(tt.template)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			typed := &metadataCacheStepImpl{config: testConfig(), rules: rules}
+			templated := &metadataCacheStepImpl{config: testConfig(), rules: rules, tmpl: tmpl}
+
+			create := func(si *metadataCacheStepImpl) (string, string, error) {
+				if tt.single == true {
+					return si.createSinglePidMetadataContent(item)
+				}
+				return si.createMultiPidMetadataContent(item)
+			}
+
+			var expected, rendered map[string]interface{}
+			content, _, err := create(typed)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			_ = json.Unmarshal([]byte(content), &expected)
+			content, _, err = create(templated)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err = json.Unmarshal([]byte(content), &rendered); err != nil {
+				t.Fatalf("expected valid json, got %s (%s)", content, err)
+			}
+
+			// the generation time differs between the renders, it just has to be there
+			if generated, _ := rendered["generated_at"].(string); len(generated) == 0 {
+				t.Errorf("generated_at: expected a value, got %v", rendered["generated_at"])
+			}
+			for _, key := range []string{"schema_version", "service_version", "sources"} {
+				if reflect.DeepEqual(rendered[key], expected[key]) == false {
+					t.Errorf("%s: expected %v, got %v", key, expected[key], rendered[key])
+				}
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// all our metrics share this namespace
+var metricsNamespace = "virgo4_tracksys_enrich"
+
+// the endpoint labels used for the outbound http metrics
+var endpointKnownIds = "known_ids"
+var endpointDetails = "details"
+var endpointPidDetails = "pid_details"
+var endpointRights = "rights"
+var endpointPdfStatus = "pdf_status"
+var endpointIIIFManifest = "iiif_manifest"
+
+//
+// message metrics
+//
+
+var messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "messages_received_total",
+	Help:      "Messages received from the inbound queue by each worker",
+}, []string{"worker"})
+
+var messagesPut = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "messages_put_total",
+	Help:      "Messages successfully put to the outbound queue by each worker",
+}, []string{"worker"})
+
+var messagesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "messages_deleted_total",
+	Help:      "Messages successfully deleted from the inbound queue by each worker",
+}, []string{"worker"})
+
+var messagesDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "messages_dead_lettered_total",
+	Help:      "Messages successfully put to the dead letter queue by each worker",
+}, []string{"worker"})
+
+//
+// pipeline metrics
+//
+
+var stepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "pipeline_step_duration_seconds",
+	Help:      "Duration of each enrich pipeline step",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+}, []string{"step"})
+
+var stepErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "pipeline_step_errors_total",
+	Help:      "Errors returned by each enrich pipeline step",
+}, []string{"step"})
+
+//
+// cache metrics
+//
+
+var cacheReloads = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_reloads_total",
+	Help:      "Tracksys ID cache reloads",
+})
+
+var cacheReloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_reload_duration_seconds",
+	Help:      "Duration of the Tracksys ID cache reloads",
+	Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+})
+
+var cacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_size",
+	Help:      "Number of identifiers in the Tracksys ID cache",
+})
+
+var cacheReloadFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_reload_failures_total",
+	Help:      "Tracksys ID cache reload failures",
+})
+
+var cacheLastLoaded = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_last_loaded_timestamp_seconds",
+	Help:      "When the Tracksys ID cache was last successfully loaded",
+})
+
+var cacheSuspended = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_suspended",
+	Help:      "1 when the Tracksys ID cache grace period has expired and queue consumption is paused",
+})
+
+var cacheIdsAdded = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_ids_added_total",
+	Help:      "Identifiers added to the Tracksys ID cache across reloads",
+})
+
+var cacheIdsRemoved = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_ids_removed_total",
+	Help:      "Identifiers removed from the Tracksys ID cache across reloads",
+})
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_lookups_total",
+	Help:      "Tracksys ID cache lookups by result (hit or miss)",
+}, []string{"result"})
+
+var detailsCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "details_cache_lookups_total",
+	Help:      "Tracksys details cache lookups by type (item or pid) and result (hit or miss)",
+}, []string{"type", "result"})
+
+//
+// outbound http metrics
+//
+
+var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "http_request_duration_seconds",
+	Help:      "Duration of outbound http requests by endpoint",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+}, []string{"endpoint"})
+
+var httpStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "http_requests_total",
+	Help:      "Outbound http requests by endpoint and status (or error)",
+}, []string{"endpoint", "status"})
+
+var httpRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "http_retries_total",
+	Help:      "Outbound http request retries by endpoint",
+}, []string{"endpoint"})
+
+//
+// S3 metrics
+//
+
+var s3UploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "s3_upload_duration_seconds",
+	Help:      "Duration of the digital content cache uploads",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+})
+
+var s3UploadErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "s3_upload_errors_total",
+	Help:      "Digital content cache upload failures",
+})
+
+var s3UploadsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "s3_uploads_skipped_total",
+	Help:      "Digital content cache uploads skipped because the content is unchanged",
+})
+
+var cacheWithdrawals = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_withdrawals_total",
+	Help:      "Metadata cache entries withdrawn for deleted or orphaned items by policy",
+}, []string{"policy"})
+
+// WorkerMetrics - the message metrics for a specific worker
+type WorkerMetrics struct {
+	Received     prometheus.Counter
+	Put          prometheus.Counter
+	Deleted      prometheus.Counter
+	DeadLettered prometheus.Counter
+}
+
+// NewWorkerMetrics - the factory
+func NewWorkerMetrics(id int) *WorkerMetrics {
+	label := strconv.Itoa(id)
+	return &WorkerMetrics{
+		Received:     messagesReceived.WithLabelValues(label),
+		Put:          messagesPut.WithLabelValues(label),
+		Deleted:      messagesDeleted.WithLabelValues(label),
+		DeadLettered: messagesDeadLettered.WithLabelValues(label),
+	}
+}
+
+// count the successful operations in the supplied status list
+func countSuccessful(ops []awssqs.OpStatus) int {
+	count := 0
+	for _, op := range ops {
+		if op == true {
+			count++
+		}
+	}
+	return count
+}
+
+//
+// end of file
+//
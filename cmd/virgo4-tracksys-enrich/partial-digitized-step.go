@@ -1,8 +1,8 @@
 package main
 
 import (
-	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
+	"strings"
 )
 
 // BarcodeFieldName the name of the field we are interested in
@@ -11,60 +11,168 @@ var BarcodeFieldName = "barcode_e_stored"
 // PartiallyDigitizedFieldName the name of the field to add if appropriate
 var PartiallyDigitizedFieldName = "digitized_f_stored"
 
-// PartiallyDigitizedFieldValue the value of the field to add if appropriate
+// FullyDigitizedFieldValue the value of the field when every barcode is digitized. Note this is a change to
+// the field, historically fully digitized items did not get it at all
+var FullyDigitizedFieldValue = "full"
+
+// PartiallyDigitizedFieldValue the value of the field when only some barcodes are digitized
 var PartiallyDigitizedFieldValue = "partial"
 
+// UnmatchedDigitizedFieldValue the value of the field when Tracksys has digitized barcodes we do not
+var UnmatchedDigitizedFieldValue = "unmatched"
+
+// DigitizedBarcodeFieldName the name of the field listing the barcodes that are digitized
+var DigitizedBarcodeFieldName = "digitized_barcode_e_stored"
+
+// UndigitizedBarcodeFieldName the name of the field listing the barcodes that are not digitized
+var UndigitizedBarcodeFieldName = "undigitized_barcode_e_stored"
+
 //var errorNoBarcodes = fmt.Errorf("failed to extract barcode fields")
 
 // this is our actual implementation
 type partialDigitizedStepImpl struct {
-	//rewriteFields map[string]string // the fields to rewrite and their rewritten values
+	barcodeField            string // the field containing the barcodes
+	digitizedField          string // the field to add the digitized state to
+	fullValue               string // the digitized state values
+	partialValue            string
+	unmatchedValue          string
+	digitizedBarcodeField   string // the field listing the digitized barcodes
+	undigitizedBarcodeField string // the field listing the barcodes that are not digitized
 }
 
 // NewPartialDigitizedStep - the factory
-func NewPartialDigitizedStep(config *ServiceConfig) PipelineStep {
+func NewPartialDigitizedStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
 
 	// mock implementation here if necessary
 
+	err := options.Validate("barcode_field", "digitized_field", "full_value", "partial_value", "unmatched_value",
+		"digitized_barcode_field", "undigitized_barcode_field")
+	if err != nil {
+		return nil, err
+	}
+
 	impl := &partialDigitizedStepImpl{}
-	return impl
+	impl.barcodeField = options.Get("barcode_field", BarcodeFieldName)
+	impl.digitizedField = options.Get("digitized_field", PartiallyDigitizedFieldName)
+	impl.fullValue = options.Get("full_value", FullyDigitizedFieldValue)
+	impl.partialValue = options.Get("partial_value", PartiallyDigitizedFieldValue)
+	impl.unmatchedValue = options.Get("unmatched_value", UnmatchedDigitizedFieldValue)
+	impl.digitizedBarcodeField = options.Get("digitized_barcode_field", DigitizedBarcodeFieldName)
+	impl.undigitizedBarcodeField = options.Get("undigitized_barcode_field", UndigitizedBarcodeFieldName)
+	return impl, nil
 }
 
 func (si *partialDigitizedStepImpl) Name() string {
-	return "Partial digitized"
+	return stepNamePartialDigitized
+}
+
+func (si *partialDigitizedStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextSolrDoc, ContextTracksys}
 }
 
-func (si *partialDigitizedStepImpl) Process(message *awssqs.Message, data interface{}) (bool, interface{}, error) {
+func (si *partialDigitizedStepImpl) Provides() []ContextItem {
+	return []ContextItem{ContextDigitized}
+}
 
-	current := string(message.Payload)
+func (si *partialDigitizedStepImpl) Process(ctx *EnrichContext) (bool, error) {
 
-	barcodes := ExtractXmlFields(current, BarcodeFieldName)
-	if len(barcodes) != 0 {
-		log.Printf("INFO: extracted %d barcode field(s)", len(barcodes))
+	doc, err := ctx.Document()
+	if err != nil {
+		return false, err
+	}
 
-		tracksysData, ok := data.(TracksysSirsiItem)
-		if ok == false {
-			log.Printf("ERROR: failed to type assert into known payload")
-			return false, data, ErrorTypeAssertion
+	barcodes := uniqueBarcodes(doc.Get(si.barcodeField))
+	if len(barcodes) == 0 {
+		// we are now processing items without barcodes so this error case is not
+		// terminal to the pipeline
+		ctx.Warning("failed to extract barcode fields")
+		return true, nil
+	}
+	log.Printf("INFO: extracted %d barcode(s)", len(barcodes))
+
+	tracksysBarcodes := make([]string, 0, len(ctx.Tracksys.Items))
+	for _, p := range ctx.Tracksys.Items {
+		tracksysBarcodes = append(tracksysBarcodes, p.Barcode)
+	}
+	tracksysBarcodes = uniqueBarcodes(tracksysBarcodes)
+	log.Printf("INFO: tracksys reports %d digitized part(s), %d with a barcode", len(ctx.Tracksys.Items), len(tracksysBarcodes))
+
+	// without any Tracksys barcodes there is nothing to match against so we compare the number of barcodes
+	// with the number of digitized parts (the historical behavior)
+	if len(tracksysBarcodes) == 0 {
+		state := si.fullValue
+		if len(ctx.Tracksys.Items) > len(barcodes) {
+			ctx.Warning("tracksys has more digitized parts than the record has barcodes")
+			state = si.unmatchedValue
+		} else if len(ctx.Tracksys.Items) < len(barcodes) {
+			state = si.partialValue
 		}
+		log.Printf("INFO: tracksys parts have no barcodes, marking as %s digitized by part count (%d part(s), %d barcode(s))",
+			state, len(ctx.Tracksys.Items), len(barcodes))
+		si.markDigitized(ctx, state, nil, nil)
+		return true, nil
+	}
 
-		digitizedObjectCount := len(tracksysData.Items)
-		log.Printf("INFO: tracksys reports %d digitized item(s)", digitizedObjectCount)
+	digitized, undigitized := matchBarcodes(barcodes, tracksysBarcodes)
+	_, unmatched := matchBarcodes(tracksysBarcodes, barcodes)
 
-		// we have more items than records of digital items so this should be tagged
-		if len(barcodes) != digitizedObjectCount {
-			log.Printf("INFO: marking as partially digitized")
-			current = AppendXmlField(current, PartiallyDigitizedFieldName, PartiallyDigitizedFieldValue)
-			message.Payload = []byte(current)
+	// determine the digitized state
+	state := si.fullValue
+	if len(unmatched) != 0 {
+		ctx.Warning("tracksys has digitized barcode(s) not present in the record: " + strings.Join(unmatched, ", "))
+		state = si.unmatchedValue
+	} else if len(undigitized) != 0 {
+		state = si.partialValue
+	}
+	log.Printf("INFO: marking as %s digitized (%d of %d barcode(s))", state, len(digitized), len(barcodes))
+	si.markDigitized(ctx, state, digitized, undigitized)
+
+	return true, nil
+}
+
+// note the digitized state, there is no state field if the state value is empty
+func (si *partialDigitizedStepImpl) markDigitized(ctx *EnrichContext, state string, digitized []string, undigitized []string) {
+
+	if len(state) != 0 {
+		ctx.AddField(si.digitizedField, state)
+	}
+	ctx.AddField(si.digitizedBarcodeField, digitized...)
+	ctx.AddField(si.undigitizedBarcodeField, undigitized...)
+	ctx.Digitized = state
+}
+
+// the non-empty barcodes without duplicates, in their original order
+func uniqueBarcodes(barcodes []string) []string {
+	seen := make(map[string]bool)
+	res := make([]string, 0, len(barcodes))
+	for _, b := range barcodes {
+		b = strings.TrimSpace(b)
+		if len(b) != 0 && seen[b] == false {
+			seen[b] = true
+			res = append(res, b)
 		}
+	}
+	return res
+}
 
-		return true, data, nil
+// split the barcodes into those that are present in the candidates and those that are not
+func matchBarcodes(barcodes []string, candidates []string) ([]string, []string) {
+
+	present := make(map[string]bool)
+	for _, c := range candidates {
+		present[c] = true
 	}
 
-	// we are now processing items without barcodes so this error case is not
-	// terminal to the pipeline
-	log.Printf("WARNING: failed to extract barcode fields")
-	return true, data, nil
+	matched := make([]string, 0, len(barcodes))
+	unmatched := make([]string, 0)
+	for _, b := range barcodes {
+		if present[b] == true {
+			matched = append(matched, b)
+		} else {
+			unmatched = append(unmatched, b)
+		}
+	}
+	return matched, unmatched
 }
 
 //
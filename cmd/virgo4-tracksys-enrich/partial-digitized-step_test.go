@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchBarcodes(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		barcodes   []string
+		candidates []string
+		matched    []string
+		unmatched  []string
+	}{
+		{"all", []string{"a", "b"}, []string{"b", "a"}, []string{"a", "b"}, []string{}},
+		{"some", []string{"a", "b", "c"}, []string{"b"}, []string{"b"}, []string{"a", "c"}},
+		{"none", []string{"a"}, []string{}, []string{}, []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, unmatched := matchBarcodes(tt.barcodes, tt.candidates)
+			if reflect.DeepEqual(matched, tt.matched) == false || reflect.DeepEqual(unmatched, tt.unmatched) == false {
+				t.Errorf("expected %v/%v, got %v/%v", tt.matched, tt.unmatched, matched, unmatched)
+			}
+		})
+	}
+
+	if got := uniqueBarcodes([]string{" a", "b", "a ", "", "b"}); reflect.DeepEqual(got, []string{"a", "b"}) == false {
+		t.Errorf("unexpected unique barcodes %v", got)
+	}
+}
+
+func TestPartialDigitizedProcess(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		options  StepOptions
+		barcodes []string // in the record
+		parts    []string // the Tracksys part barcodes
+		expected map[string][]string
+	}{
+		{"full", nil, []string{"a", "b"}, []string{"a", "b"},
+			map[string][]string{"digitized_f_stored": {"full"}, "digitized_barcode_e_stored": {"a", "b"}, "undigitized_barcode_e_stored": {}}},
+		{"full value configured", StepOptions{"full_value": "complete"}, []string{"a"}, []string{"a"},
+			map[string][]string{"digitized_f_stored": {"complete"}}},
+		{"partial", nil, []string{"a", "b"}, []string{"a"},
+			map[string][]string{"digitized_f_stored": {"partial"}, "digitized_barcode_e_stored": {"a"}, "undigitized_barcode_e_stored": {"b"}}},
+		{"unmatched", nil, []string{"a"}, []string{"a", "z"},
+			map[string][]string{"digitized_f_stored": {"unmatched"}}},
+		{"no part barcodes, fewer parts", nil, []string{"a", "b"}, []string{""},
+			map[string][]string{"digitized_f_stored": {"partial"}, "digitized_barcode_e_stored": {}}},
+		{"no part barcodes, same parts", nil, []string{"a", "b"}, []string{"", ""},
+			map[string][]string{"digitized_f_stored": {"full"}, "digitized_barcode_e_stored": {}}},
+		{"no part barcodes, more parts", nil, []string{"a"}, []string{"", ""},
+			map[string][]string{"digitized_f_stored": {"unmatched"}, "undigitized_barcode_e_stored": {}}},
+		{"no record barcodes", nil, []string{}, []string{"a"},
+			map[string][]string{"digitized_f_stored": {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := NewPartialDigitizedStep(&ServiceConfig{}, nil, tt.options)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			payload := `<add><doc><field name="id">u1</field>`
+			for _, b := range tt.barcodes {
+				payload += `<field name="barcode_e_stored">` + b + `</field>`
+			}
+			payload += `</doc></add>`
+			ctx := NewEnrichContext("sirsi", testMessage("u1", payload))
+			ctx.Tracksys = &TracksysSirsiItem{SirsiId: "u1"}
+			for _, b := range tt.parts {
+				ctx.Tracksys.Items = append(ctx.Tracksys.Items, TracksysPart{Barcode: b})
+			}
+
+			_, err = step.Process(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for field, expected := range tt.expected {
+				values, _ := ctx.Field(field)
+				if reflect.DeepEqual(values, expected) == false {
+					t.Errorf("%s: expected %v, got %v", field, expected, values)
+				}
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
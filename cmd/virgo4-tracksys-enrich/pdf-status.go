@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// the PDF service status when a PDF is available for download
+var pdfStatusReady = "READY"
+
+// the PDF feature values, depending on how many of the parts have a ready PDF
+var pdfFeatureAll = "pdf_available_all"
+var pdfFeatureSome = "pdf_available_some"
+var pdfFeatureNone = "pdf_available_none"
+
+// PdfStatusClient - our interface
+type PdfStatusClient interface {
+
+	// get the PDF status of each part from the PDF service root for that part (in part order), any error
+	// means a PDF is not available and results in an empty status
+	Status([]string, []string) []string
+}
+
+// the PDF status client is shared by all the workers so they share the cache
+var sharedPdfStatusClient PdfStatusClient
+var sharedPdfStatusClientOnce sync.Once
+
+// this is our actual implementation
+type pdfStatusClientImpl struct {
+	concurrency int                          // the maximum number of concurrent status requests for an item
+	ready       *expirable.LRU[string, bool] // the PDF's recently reported as ready, nil if not configured
+	httpClient  *http.Client                 // our http client connection
+}
+
+// NewPdfStatusClient - the factory
+func NewPdfStatusClient(config *ServiceConfig) PdfStatusClient {
+
+	sharedPdfStatusClientOnce.Do(func() {
+		impl := &pdfStatusClientImpl{}
+		impl.concurrency = config.PdfStatusConcurrency
+		if impl.concurrency <= 0 {
+			impl.concurrency = 1
+		}
+		if config.PdfReadyCacheSize > 0 && config.PdfReadyCacheTTL > 0 {
+			impl.ready = expirable.NewLRU[string, bool](config.PdfReadyCacheSize, nil, time.Duration(config.PdfReadyCacheTTL)*time.Second)
+		}
+		impl.httpClient = newHttpClient(config.Workers*config.PdfStatusConcurrency, config.ServiceTimeout)
+		sharedPdfStatusClient = impl
+	})
+	return sharedPdfStatusClient
+}
+
+func (pc *pdfStatusClientImpl) Status(pdfRoots []string, pids []string) []string {
+
+	status := make([]string, len(pids))
+	limit := make(chan struct{}, pc.concurrency)
+	var wg sync.WaitGroup
+
+	for ix, pid := range pids {
+
+		if len(pid) == 0 || len(pdfRoots[ix]) == 0 {
+			continue
+		}
+
+		// only ready results are cached, anything else may change at any time
+		url := fmt.Sprintf("%s/%s/status", pdfRoots[ix], pid)
+		if pc.ready != nil {
+			if _, found := pc.ready.Get(url); found == true {
+				detailsCacheLookups.WithLabelValues("pdf", "hit").Inc()
+				status[ix] = pdfStatusReady
+				continue
+			}
+			detailsCacheLookups.WithLabelValues("pdf", "miss").Inc()
+		}
+
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(ix int, url string) {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			// we will assume any error means a PDF is not available
+			body, err := httpGet(url, endpointPdfStatus, pc.httpClient)
+			if err != nil {
+				return
+			}
+			status[ix] = string(body)
+			if status[ix] == pdfStatusReady && pc.ready != nil {
+				pc.ready.Add(url, true)
+			}
+		}(ix, url)
+	}
+	wg.Wait()
+
+	return status
+}
+
+// the PDF feature value for the supplied part status
+func pdfFeature(status []string) string {
+
+	ready := 0
+	for _, s := range status {
+		if s == pdfStatusReady {
+			ready++
+		}
+	}
+
+	switch {
+	case ready == 0:
+		return pdfFeatureNone
+	case ready == len(status):
+		return pdfFeatureAll
+	default:
+		return pdfFeatureSome
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+// the names of the available pipeline steps
+var stepNameTracksysExtract = "tracksys-extract"
+var stepNameTracksysEnrich = "tracksys-enrich"
+var stepNameFieldRewrite = "field-rewrite"
+var stepNamePartialDigitized = "partial-digitized"
+var stepNameMetadataCache = "metadata-cache"
+var stepNameIIIFManifest = "iiif-manifest"
+var stepNameCacheWithdraw = "cache-withdraw"
+
+// StepOptions - the per-step options from the pipeline definition
+type StepOptions map[string]string
+
+// StepDefinition - a single step of the pipeline definition
+type StepDefinition struct {
+	Name    string      `json:"name"`
+	Options StepOptions `json:"options,omitempty"`
+}
+
+// PipelineDefinition - the ordered list of steps that make up the pipeline
+type PipelineDefinition struct {
+	Steps []StepDefinition `json:"steps"`
+}
+
+// StepFactory - creates a pipeline step from the service configuration, the digital content cache store and
+// the step options
+type StepFactory func(*ServiceConfig, ContentCacheStore, StepOptions) (PipelineStep, error)
+
+// the registry of available steps
+var stepRegistry = make(map[string]StepFactory)
+
+// RegisterStep - make a step available to pipeline definitions
+func RegisterStep(name string, factory StepFactory) {
+	stepRegistry[name] = factory
+}
+
+func init() {
+	RegisterStep(stepNameTracksysExtract, NewTracksysExtractStep)
+	RegisterStep(stepNameTracksysEnrich, NewTracksysEnrichStep)
+	RegisterStep(stepNameFieldRewrite, NewFieldRewriteStep)
+	RegisterStep(stepNamePartialDigitized, NewPartialDigitizedStep)
+	RegisterStep(stepNameMetadataCache, NewMetaDataCacheStep)
+	RegisterStep(stepNameIIIFManifest, NewIIIFManifestStep)
+	RegisterStep(stepNameCacheWithdraw, NewCacheWithdrawStep)
+}
+
+// LoadPipelineDefinition - load the pipeline definition from the configured file or use the default for our mode
+func LoadPipelineDefinition(config *ServiceConfig) (*PipelineDefinition, error) {
+
+	if len(config.PipelineFile) == 0 {
+		return defaultPipelineDefinition(config), nil
+	}
+
+	buf, err := ioutil.ReadFile(config.PipelineFile)
+	if err != nil {
+		return nil, err
+	}
+
+	def := PipelineDefinition{}
+	err = json.Unmarshal(buf, &def)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of PipelineDefinition: %s", err)
+		return nil, err
+	}
+
+	if len(def.Steps) == 0 {
+		return nil, fmt.Errorf("pipeline definition %s contains no steps", config.PipelineFile)
+	}
+	return &def, nil
+}
+
+// the historical pipeline, Sirsi items get the additional enrich step and the cache entries of items no
+// longer in Tracksys are withdrawn first if configured
+func defaultPipelineDefinition(config *ServiceConfig) *PipelineDefinition {
+
+	def := PipelineDefinition{}
+	if config.CacheWithdrawnPolicy != cacheWithdrawnPolicyKeep {
+		def.Steps = append(def.Steps, StepDefinition{Name: stepNameCacheWithdraw})
+	}
+	def.Steps = append(def.Steps, StepDefinition{Name: stepNameTracksysExtract})
+	if config.Mode == "sirsi" {
+		def.Steps = append(def.Steps, StepDefinition{Name: stepNameTracksysEnrich})
+	}
+	def.Steps = append(def.Steps, StepDefinition{Name: stepNameFieldRewrite})
+	def.Steps = append(def.Steps, StepDefinition{Name: stepNamePartialDigitized})
+	def.Steps = append(def.Steps, StepDefinition{Name: stepNameMetadataCache})
+	return &def
+}
+
+// resolve the pipeline definition into the actual steps
+func resolvePipeline(config *ServiceConfig, store ContentCacheStore, def *PipelineDefinition) ([]PipelineStep, error) {
+
+	steps := make([]PipelineStep, 0, len(def.Steps))
+	for ix, sd := range def.Steps {
+		factory, found := stepRegistry[sd.Name]
+		if found == false {
+			return nil, fmt.Errorf("pipeline step %d: unknown step [%s] (available: %v)", ix, sd.Name, registeredSteps())
+		}
+
+		step, err := factory(config, store, sd.Options)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline step %d (%s): %s", ix, sd.Name, err)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func registeredSteps() []string {
+	names := make([]string, 0, len(stepRegistry))
+	for name := range stepRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate - ensure only the supplied option names are used
+func (so StepOptions) Validate(known ...string) error {
+	for name := range so {
+		ok := false
+		for _, k := range known {
+			if name == k {
+				ok = true
+				break
+			}
+		}
+		if ok == false {
+			return fmt.Errorf("unknown option [%s]", name)
+		}
+	}
+	return nil
+}
+
+// Get - get the named option or the default value if it is not set
+func (so StepOptions) Get(name string, defaultValue string) string {
+	value, found := so[name]
+	if found == false || len(value) == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+//
+// end of file
+//
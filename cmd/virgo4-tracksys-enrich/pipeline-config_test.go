@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a step that only declares its context items
+type contextStep struct {
+	requires []ContextItem
+	provides []ContextItem
+}
+
+func (cs *contextStep) Name() string                         { return "context" }
+func (cs *contextStep) Requires() []ContextItem              { return cs.requires }
+func (cs *contextStep) Provides() []ContextItem              { return cs.provides }
+func (cs *contextStep) Process(*EnrichContext) (bool, error) { return true, nil }
+
+func TestDefaultPipelineDefinition(t *testing.T) {
+
+	tests := []struct {
+		mode     string
+		policy   string
+		expected []string
+	}{
+		{"sirsi", cacheWithdrawnPolicyKeep, []string{stepNameTracksysExtract, stepNameTracksysEnrich, stepNameFieldRewrite, stepNamePartialDigitized, stepNameMetadataCache}},
+		{"other", cacheWithdrawnPolicyKeep, []string{stepNameTracksysExtract, stepNameFieldRewrite, stepNamePartialDigitized, stepNameMetadataCache}},
+		{"other", cacheWithdrawnPolicyDelete, []string{stepNameCacheWithdraw, stepNameTracksysExtract, stepNameFieldRewrite, stepNamePartialDigitized, stepNameMetadataCache}},
+	}
+
+	for _, tt := range tests {
+		def := defaultPipelineDefinition(&ServiceConfig{Mode: tt.mode, CacheWithdrawnPolicy: tt.policy})
+		names := make([]string, 0, len(def.Steps))
+		for _, s := range def.Steps {
+			names = append(names, s.Name)
+			if _, found := stepRegistry[s.Name]; found == false {
+				t.Errorf("step %s is not registered", s.Name)
+			}
+		}
+		if reflect.DeepEqual(names, tt.expected) == false {
+			t.Errorf("%s/%s: expected %v, got %v", tt.mode, tt.policy, tt.expected, names)
+		}
+	}
+}
+
+func TestValidatePipeline(t *testing.T) {
+
+	extract := &contextStep{requires: []ContextItem{ContextRecordId}, provides: []ContextItem{ContextTracksys}}
+	cache := &contextStep{requires: []ContextItem{ContextTracksys}, provides: []ContextItem{ContextCacheUrl}}
+
+	if err := validatePipeline([]PipelineStep{extract, cache}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := validatePipeline([]PipelineStep{cache, extract}); err == nil {
+		t.Errorf("expected an error when a required item is provided by a later step")
+	}
+}
+
+func TestStepOptions(t *testing.T) {
+
+	options := StepOptions{"a": "1", "b": ""}
+	if err := options.Validate("a", "b"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := options.Validate("a"); err == nil {
+		t.Errorf("expected an unknown option error")
+	}
+	if options.Get("a", "x") != "1" || options.Get("b", "x") != "x" || options.Get("c", "x") != "x" {
+		t.Errorf("unexpected option values")
+	}
+}
+
+//
+// end of file
+//
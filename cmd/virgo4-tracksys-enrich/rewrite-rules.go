@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+)
+
+// the supported rewrite operations
+var rewriteOpSet = "set"
+var rewriteOpReplace = "replace"
+var rewriteOpAppend = "append"
+var rewriteOpRemove = "remove"
+var rewriteOpRename = "rename"
+
+// RewriteRules - the ordered field rewrite rules
+type RewriteRules struct {
+	Rules []RewriteRule `json:"rules"`
+}
+
+// RewriteRule - a single field rewrite, applied only when all of its conditions are met
+type RewriteRule struct {
+	Op          string             `json:"op"`                    // the operation
+	Field       string             `json:"field"`                 // the field the operation applies to
+	Values      []string           `json:"values,omitempty"`      // the values for set and append
+	Pattern     string             `json:"pattern,omitempty"`     // the regex for replace, optional for remove to select values
+	Replacement string             `json:"replacement,omitempty"` // the replacement for replace (may reference groups, e.g. $1)
+	To          string             `json:"to,omitempty"`          // the new field name for rename
+	When        []RewriteCondition `json:"when,omitempty"`        // the conditions
+
+	pattern *regexp.Regexp // the compiled pattern
+}
+
+// RewriteCondition - a condition on the current values of a Solr field or on a Tracksys attribute (as
+// named in the field mapping). Met when any value equals or matches, or when there are no values if absent
+type RewriteCondition struct {
+	Field    string `json:"field,omitempty"`
+	Tracksys string `json:"tracksys,omitempty"`
+	Equals   string `json:"equals,omitempty"`
+	Matches  string `json:"matches,omitempty"`
+	Absent   bool   `json:"absent,omitempty"`
+
+	matches *regexp.Regexp // the compiled pattern
+}
+
+// LoadRewriteRules - load, validate and compile the rewrite rules file
+func LoadRewriteRules(filename string) (*RewriteRules, error) {
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := RewriteRules{}
+	err = json.Unmarshal(buf, &rules)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of RewriteRules: %s", err)
+		return nil, err
+	}
+
+	for ix := range rules.Rules {
+		err = rules.Rules[ix].compile()
+		if err != nil {
+			return nil, fmt.Errorf("%s: rewrite rule %d (%s %s): %s", filename, ix, rules.Rules[ix].Op, rules.Rules[ix].Field, err)
+		}
+	}
+
+	log.Printf("INFO: loaded %d rewrite rules from %s", len(rules.Rules), filename)
+	return &rules, nil
+}
+
+func (rule *RewriteRule) compile() error {
+
+	if len(rule.Field) == 0 {
+		return fmt.Errorf("no field name")
+	}
+
+	var err error
+	switch rule.Op {
+	case rewriteOpSet, rewriteOpAppend:
+		if len(rule.Values) == 0 {
+			return fmt.Errorf("values are required")
+		}
+	case rewriteOpReplace:
+		if len(rule.Pattern) == 0 {
+			return fmt.Errorf("a pattern is required")
+		}
+	case rewriteOpRemove:
+	case rewriteOpRename:
+		if len(rule.To) == 0 || rule.To == rule.Field {
+			return fmt.Errorf("a different field name is required")
+		}
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+
+	if len(rule.Pattern) != 0 {
+		rule.pattern, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	for ix := range rule.When {
+		err = rule.When[ix].compile()
+		if err != nil {
+			return fmt.Errorf("condition %d: %s", ix, err)
+		}
+	}
+	return nil
+}
+
+func (cond *RewriteCondition) compile() error {
+
+	if (len(cond.Field) == 0) == (len(cond.Tracksys) == 0) {
+		return fmt.Errorf("one of field or tracksys is required")
+	}
+	if len(cond.Tracksys) != 0 && (knownAttribute(cond.Tracksys) == false || computedAttribute(cond.Tracksys) == true) {
+		return fmt.Errorf("unknown tracksys attribute [%s]", cond.Tracksys)
+	}
+	if cond.Absent == true && (len(cond.Equals) != 0 || len(cond.Matches) != 0) {
+		return fmt.Errorf("absent cannot be combined with equals or matches")
+	}
+
+	if len(cond.Matches) != 0 {
+		var err error
+		cond.matches, err = regexp.Compile(cond.Matches)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply - apply the rules in order to the enrich context
+func (rr *RewriteRules) Apply(ctx *EnrichContext) error {
+
+	for _, rule := range rr.Rules {
+
+		met, err := rule.conditionsMet(ctx)
+		if err != nil {
+			return err
+		}
+		if met == false {
+			continue
+		}
+
+		current, err := ctx.Field(rule.Field)
+		if err != nil {
+			return err
+		}
+
+		switch rule.Op {
+		case rewriteOpSet:
+			ctx.ReplaceField(rule.Field, rule.Values...)
+
+		case rewriteOpAppend:
+			ctx.AddField(rule.Field, rule.Values...)
+
+		case rewriteOpReplace:
+			values := make([]string, 0, len(current))
+			for _, v := range current {
+				values = append(values, rule.pattern.ReplaceAllString(v, rule.Replacement))
+			}
+			ctx.ReplaceField(rule.Field, nonEmpty(values)...)
+
+		case rewriteOpRemove:
+			values := make([]string, 0, len(current))
+			if rule.pattern != nil {
+				for _, v := range current {
+					if rule.pattern.MatchString(v) == false {
+						values = append(values, v)
+					}
+				}
+			}
+			ctx.ReplaceField(rule.Field, values...)
+
+		case rewriteOpRename:
+			if len(current) == 0 {
+				continue
+			}
+			existing, err := ctx.Field(rule.To)
+			if err != nil {
+				return err
+			}
+			ctx.ReplaceField(rule.Field)
+			ctx.ReplaceField(rule.To, append(existing, current...)...)
+		}
+	}
+
+	return nil
+}
+
+func (rule *RewriteRule) conditionsMet(ctx *EnrichContext) (bool, error) {
+
+	for _, cond := range rule.When {
+		var values []string
+		if len(cond.Field) != 0 {
+			var err error
+			values, err = ctx.Field(cond.Field)
+			if err != nil {
+				return false, err
+			}
+		} else if ctx.Tracksys != nil {
+			values = sourceValues(cond.Tracksys, ctx.Tracksys, ctx.Tracksys.Items, nil)
+		}
+
+		if cond.met(nonEmpty(values)) == false {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (cond *RewriteCondition) met(values []string) bool {
+
+	if cond.Absent == true {
+		return len(values) == 0
+	}
+
+	for _, v := range values {
+		if len(cond.Equals) != 0 && v != cond.Equals {
+			continue
+		}
+		if cond.matches != nil && cond.matches.MatchString(v) == false {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+//
+// end of file
+//
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
+)
+
+func TestLoadDefaultRewriteRules(t *testing.T) {
+	_, err := LoadRewriteRules(testMappingsDir + "/rewrite-rules.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestRewriteRuleCompile(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		rule  RewriteRule
+		valid bool
+	}{
+		{"set", RewriteRule{Op: "set", Field: "f", Values: []string{"v"}}, true},
+		{"set without values", RewriteRule{Op: "set", Field: "f"}, false},
+		{"no field", RewriteRule{Op: "remove"}, false},
+		{"unknown op", RewriteRule{Op: "drop", Field: "f"}, false},
+		{"replace without pattern", RewriteRule{Op: "replace", Field: "f"}, false},
+		{"invalid pattern", RewriteRule{Op: "replace", Field: "f", Pattern: "("}, false},
+		{"rename to itself", RewriteRule{Op: "rename", Field: "f", To: "f"}, false},
+		{"condition without source", RewriteRule{Op: "remove", Field: "f", When: []RewriteCondition{{Equals: "x"}}}, false},
+		{"condition on computed attribute", RewriteRule{Op: "remove", Field: "f", When: []RewriteCondition{{Tracksys: "policy"}}}, false},
+		{"absent with equals", RewriteRule{Op: "remove", Field: "f", When: []RewriteCondition{{Field: "g", Absent: true, Equals: "x"}}}, false},
+		{"tracksys condition", RewriteRule{Op: "remove", Field: "f", When: []RewriteCondition{{Tracksys: "collection", Equals: "Gannon"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.compile()
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestRewriteRulesApply(t *testing.T) {
+
+	payload := `<add><doc><field name="id">u1</field><field name="a">one</field><field name="a">two</field><field name="b">x</field></doc></add>`
+	tests := []struct {
+		name     string
+		rule     RewriteRule
+		expected []solrdoc.Field
+	}{
+		{"set", RewriteRule{Op: "set", Field: "a", Values: []string{"new"}},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "b", Value: "x"}, {Name: "a", Value: "new"}}},
+		{"append", RewriteRule{Op: "append", Field: "b", Values: []string{"y"}},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "a", Value: "one"}, {Name: "a", Value: "two"}, {Name: "b", Value: "x"}, {Name: "b", Value: "y"}}},
+		{"replace", RewriteRule{Op: "replace", Field: "a", Pattern: "^t(.*)$", Replacement: "T$1"},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "b", Value: "x"}, {Name: "a", Value: "one"}, {Name: "a", Value: "Two"}}},
+		{"remove all", RewriteRule{Op: "remove", Field: "a"},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "b", Value: "x"}}},
+		{"remove matching", RewriteRule{Op: "remove", Field: "a", Pattern: "^o"},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "b", Value: "x"}, {Name: "a", Value: "two"}}},
+		{"rename", RewriteRule{Op: "rename", Field: "a", To: "b"},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "b", Value: "x"}, {Name: "b", Value: "one"}, {Name: "b", Value: "two"}}},
+		{"field condition met", RewriteRule{Op: "remove", Field: "b", When: []RewriteCondition{{Field: "a", Equals: "two"}}},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "a", Value: "one"}, {Name: "a", Value: "two"}}},
+		{"field condition not met", RewriteRule{Op: "remove", Field: "b", When: []RewriteCondition{{Field: "a", Matches: "^z"}}},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "a", Value: "one"}, {Name: "a", Value: "two"}, {Name: "b", Value: "x"}}},
+		{"absent condition", RewriteRule{Op: "append", Field: "c", Values: []string{"v"}, When: []RewriteCondition{{Field: "c", Absent: true}}},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "a", Value: "one"}, {Name: "a", Value: "two"}, {Name: "b", Value: "x"}, {Name: "c", Value: "v"}}},
+		{"tracksys condition", RewriteRule{Op: "remove", Field: "b", When: []RewriteCondition{{Tracksys: "part.barcode", Equals: "X001"}}},
+			[]solrdoc.Field{{Name: "id", Value: "u1"}, {Name: "a", Value: "one"}, {Name: "a", Value: "two"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			if err := rule.compile(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			rules := &RewriteRules{Rules: []RewriteRule{rule}}
+
+			ctx := NewEnrichContext("sirsi", testMessage("u1", payload))
+			ctx.Tracksys = testItem()
+			if err := rules.Apply(ctx); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := ctx.Apply(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			add, err := solrdoc.Parse(ctx.Message.Payload)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if reflect.DeepEqual(add.Doc().Fields, tt.expected) == false {
+				t.Errorf("expected %v, got %v", tt.expected, add.Doc().Fields)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
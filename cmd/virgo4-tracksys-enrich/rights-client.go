@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// the rights policy that does not appear in the policy facet
+var rightsPolicyPublic = "public"
+
+// how the part policies are combined into the policy facet
+var rightsAggregationAll = "all"     // every distinct non-public policy across the parts, in part order
+var rightsAggregationFirst = "first" // the policy of the first part only (the historical behavior)
+
+// RightsClient - our interface
+type RightsClient interface {
+
+	// get the rights policy for each of the supplied PIDs, returns the policies by PID and the PIDs that
+	// were assigned the fallback policy because the rights service was unavailable
+	Lookup([]string) (map[string]string, []string, error)
+}
+
+// the rights client is shared by all the workers so they share the cache
+var sharedRightsClient RightsClient
+var sharedRightsClientOnce sync.Once
+
+// this is our actual implementation
+type rightsClientImpl struct {
+	endpoint      string                         // the single PID rights endpoint
+	batchEndpoint string                         // the multiple PID rights endpoint (optional)
+	fallback      string                         // the policy used when the service is unavailable, empty to fail
+	cache         *expirable.LRU[string, string] // recent results, nil if not configured
+	httpClient    *http.Client                   // our http client connection
+}
+
+// NewRightsClient - the factory
+func NewRightsClient(config *ServiceConfig) RightsClient {
+
+	sharedRightsClientOnce.Do(func() {
+		impl := &rightsClientImpl{}
+		impl.endpoint = config.RightsEndpoint
+		impl.batchEndpoint = config.RightsBatchEndpoint
+		impl.fallback = config.RightsFallbackPolicy
+		if config.RightsCacheSize > 0 && config.RightsCacheTTL > 0 {
+			impl.cache = expirable.NewLRU[string, string](config.RightsCacheSize, nil, time.Duration(config.RightsCacheTTL)*time.Second)
+		}
+		impl.httpClient = newHttpClient(config.Workers, config.ServiceTimeout)
+		sharedRightsClient = impl
+	})
+	return sharedRightsClient
+}
+
+func (rc *rightsClientImpl) Lookup(pids []string) (map[string]string, []string, error) {
+
+	policies := make(map[string]string)
+	fallback := make([]string, 0)
+
+	// anything we have recently looked up
+	missing := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		if len(pid) == 0 {
+			continue
+		}
+		if _, found := policies[pid]; found == true {
+			continue
+		}
+		if rc.cache != nil {
+			if policy, found := rc.cache.Get(pid); found == true {
+				detailsCacheLookups.WithLabelValues("rights", "hit").Inc()
+				policies[pid] = policy
+				continue
+			}
+			detailsCacheLookups.WithLabelValues("rights", "miss").Inc()
+		}
+		policies[pid] = ""
+		missing = append(missing, pid)
+	}
+
+	if len(missing) == 0 {
+		return policies, fallback, nil
+	}
+
+	var found map[string]string
+	var err error
+	if len(rc.batchEndpoint) != 0 && len(missing) > 1 {
+		found, err = rc.batchLookup(missing)
+	} else {
+		found, err = rc.singleLookup(missing)
+	}
+
+	for _, pid := range missing {
+		policy, ok := found[pid]
+		if ok == true {
+			policies[pid] = policy
+			if rc.cache != nil {
+				rc.cache.Add(pid, policy)
+			}
+			continue
+		}
+
+		// the service is unavailable, use the fallback if we have one (but do not cache it)
+		if len(rc.fallback) == 0 {
+			if err == nil {
+				err = fmt.Errorf("no rights policy returned for %s", pid)
+			}
+			return nil, nil, err
+		}
+		policies[pid] = rc.fallback
+		fallback = append(fallback, pid)
+	}
+
+	return policies, fallback, nil
+}
+
+// lookup each PID individually, stops at the first failure
+func (rc *rightsClientImpl) singleLookup(pids []string) (map[string]string, error) {
+
+	res := make(map[string]string)
+	for _, pid := range pids {
+		url := fmt.Sprintf("%s/%s", rc.endpoint, pid)
+		body, err := httpGet(url, endpointRights, rc.httpClient)
+		if err != nil {
+			log.Printf("ERROR: endpoint %s returns %s", url, err)
+			return res, err
+		}
+		res[pid] = string(body)
+	}
+	return res, nil
+}
+
+// lookup all the PIDs in a single request, the batch endpoint accepts a comma separated list of PIDs and
+// returns a json object of policies keyed by PID
+func (rc *rightsClientImpl) batchLookup(pids []string) (map[string]string, error) {
+
+	requestUrl := fmt.Sprintf("%s?pids=%s", rc.batchEndpoint, url.QueryEscape(strings.Join(pids, ",")))
+	body, err := httpGet(requestUrl, endpointRights, rc.httpClient)
+	if err != nil {
+		log.Printf("ERROR: endpoint %s returns %s", requestUrl, err)
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal of rights batch response: %s", err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// aggregate the part policies (in part order) into the policy facet values
+func aggregateRights(pids []string, policies map[string]string, aggregation string) []string {
+
+	res := make([]string, 0, 1)
+	for _, pid := range pids {
+		policy, found := policies[pid]
+		if found == false {
+			continue
+		}
+		if policy != rightsPolicyPublic && len(policy) != 0 && containsValue(res, policy) == false {
+			res = append(res, policy)
+		}
+		if aggregation == rightsAggregationFirst {
+			break
+		}
+	}
+	return res
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// end of file
+//
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAggregateRights(t *testing.T) {
+
+	policies := map[string]string{"p1": "uva", "p2": "public", "p3": "cc-by", "p4": "uva", "p5": ""}
+	tests := []struct {
+		name        string
+		pids        []string
+		aggregation string
+		expected    []string
+	}{
+		{"first", []string{"p1", "p3"}, rightsAggregationFirst, []string{"uva"}},
+		{"first public", []string{"p2", "p3"}, rightsAggregationFirst, []string{}},
+		{"all", []string{"p1", "p2", "p3", "p4", "p5"}, rightsAggregationAll, []string{"uva", "cc-by"}},
+		{"all public", []string{"p2"}, rightsAggregationAll, []string{}},
+		{"unknown pid", []string{"p9", "p1"}, rightsAggregationAll, []string{"uva"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregateRights(tt.pids, policies, tt.aggregation)
+			if reflect.DeepEqual(got, tt.expected) == false {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRightsLookup(t *testing.T) {
+
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.String())
+		if strings.HasPrefix(r.URL.Path, "/batch") == true {
+			fmt.Fprint(w, `{"p1":"uva","p2":"public"}`)
+			return
+		}
+		fmt.Fprint(w, "uva")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		batch    string
+		pids     []string
+		expected map[string]string
+		requests int
+	}{
+		{"single", "", []string{"p1", "p2"}, map[string]string{"p1": "uva", "p2": "uva"}, 2},
+		{"batch", server.URL + "/batch", []string{"p1", "p2"}, map[string]string{"p1": "uva", "p2": "public"}, 1},
+		{"one pid does not use the batch", server.URL + "/batch", []string{"p1"}, map[string]string{"p1": "uva"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = requests[:0]
+			rc := &rightsClientImpl{endpoint: server.URL + "/single", batchEndpoint: tt.batch, httpClient: newHttpClient(1, 5)}
+			policies, fallback, err := rc.Lookup(tt.pids)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if reflect.DeepEqual(policies, tt.expected) == false || len(fallback) != 0 {
+				t.Errorf("expected %v, got %v (fallback %v)", tt.expected, policies, fallback)
+			}
+			if len(requests) != tt.requests {
+				t.Errorf("expected %d requests, got %v", tt.requests, requests)
+			}
+		})
+	}
+}
+
+func TestRightsLookupFallback(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	rc := &rightsClientImpl{endpoint: server.URL, httpClient: newHttpClient(1, 5)}
+	_, _, err := rc.Lookup([]string{"p1"})
+	if err == nil {
+		t.Errorf("expected an error without a fallback policy")
+	}
+
+	rc.fallback = "uva"
+	policies, fallback, err := rc.Lookup([]string{"p1"})
+	if err != nil || policies["p1"] != "uva" || reflect.DeepEqual(fallback, []string{"p1"}) == false {
+		t.Errorf("expected the fallback policy, got %v %v %v", policies, fallback, err)
+	}
+}
+
+//
+// end of file
+//
@@ -4,58 +4,175 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// the S3 object metadata that holds the hash of the object content
+var contentHashMetadataKey = "Content-Hash"
+
 // S3Proxy contains methods for accessing the S3 cache
 type S3Proxy struct {
 	bucketName string
+	client     *s3.S3
 	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
 }
 
-// NewS3Proxy creates a new S3 proxy object
-func NewS3Proxy(cfg *ServiceConfig) *S3Proxy {
+// creates a new S3 proxy object
+func newS3ContentCache(cfg *ServiceConfig) (*S3Proxy, error) {
 
-	proxy := S3Proxy{}
-	proxy.bucketName = cfg.DigitalContentCacheBucket
 	sess, err := session.NewSession()
-	if err == nil {
-		proxy.uploader = s3manager.NewUploader(sess)
+	if err != nil {
+		log.Printf("ERROR: creating the S3 session (%s)", err.Error())
+		return nil, err
 	}
 
-	return &proxy
+	proxy := S3Proxy{}
+	proxy.bucketName = cfg.DigitalContentCacheBucket
+	proxy.client = s3.New(sess)
+	proxy.uploader = s3manager.NewUploader(sess)
+	proxy.downloader = s3manager.NewDownloader(sess)
+	return &proxy, nil
 }
 
-// WriteToCache writes the contents of the specified cache element
-func (s3p *S3Proxy) WriteToCache(key string, content string) error {
+// writes the contents of the specified cache element
+func (s3p *S3Proxy) put(key string, content []byte, hash string) error {
 
 	contentSize := len(content)
-	destname := fmt.Sprintf("s3://%s/%s", s3p.bucketName, key)
+	destname := s3p.location(key)
 	log.Printf("INFO: uploading to %s (%d bytes)", destname, contentSize)
 
 	upParams := s3manager.UploadInput{
-		Bucket: &s3p.bucketName,
-		Key:    &key,
-		Body:   bytes.NewReader([]byte(content)),
+		Bucket:   &s3p.bucketName,
+		Key:      &key,
+		Body:     bytes.NewReader(content),
+		Metadata: map[string]*string{contentHashMetadataKey: aws.String(hash)},
 	}
 
 	// Perform an upload.
 	start := time.Now()
 	_, err := s3p.uploader.Upload(&upParams)
 	if err != nil {
+		s3UploadErrors.Inc()
 		log.Printf("ERROR: uploading to %s (%s)", destname, err.Error())
 		return err
 	}
 
 	duration := time.Since(start)
+	s3UploadDuration.Observe(duration.Seconds())
 	log.Printf("INFO: upload of %s complete in %0.2f seconds", destname, duration.Seconds())
 
 	return nil
 }
 
+// reads the contents of the specified cache element
+func (s3p *S3Proxy) get(key string) ([]byte, error) {
+
+	sourcename := s3p.location(key)
+	log.Printf("INFO: downloading from %s", sourcename)
+
+	downParams := s3.GetObjectInput{
+		Bucket: &s3p.bucketName,
+		Key:    &key,
+	}
+
+	start := time.Now()
+	buffer := &aws.WriteAtBuffer{}
+	_, err := s3p.downloader.Download(buffer, &downParams)
+	if err != nil {
+		log.Printf("ERROR: downloading from %s (%s)", sourcename, err.Error())
+		return nil, err
+	}
+
+	duration := time.Since(start)
+	log.Printf("INFO: download of %s complete in %0.2f seconds (%d bytes)", sourcename, duration.Seconds(), len(buffer.Bytes()))
+
+	return buffer.Bytes(), nil
+}
+
+// gets the content hash from the metadata of the specified cache element
+func (s3p *S3Proxy) hash(key string) (string, error) {
+
+	head, err := s3p.head(key)
+	if err != nil {
+		return "", err
+	}
+
+	// metadata keys are not reliably cased
+	for k, v := range head.Metadata {
+		if strings.EqualFold(k, contentHashMetadataKey) == true && v != nil {
+			return *v, nil
+		}
+	}
+	return "", nil
+}
+
+// does the specified cache element exist
+func (s3p *S3Proxy) exists(key string) (bool, error) {
+
+	_, err := s3p.head(key)
+	if err == nil {
+		return true, nil
+	}
+	if aerr, ok := err.(awserr.RequestFailure); ok == true && aerr.StatusCode() == 404 {
+		return false, nil
+	}
+	return false, err
+}
+
+// removes the specified cache element
+func (s3p *S3Proxy) remove(key string) error {
+
+	log.Printf("INFO: deleting %s", s3p.location(key))
+	_, err := s3p.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &s3p.bucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		log.Printf("ERROR: deleting %s (%s)", s3p.location(key), err.Error())
+	}
+	return err
+}
+
+// lists the keys of the cache elements with the specified prefix
+func (s3p *S3Proxy) list(prefix string) ([]string, error) {
+
+	keys := make([]string, 0)
+	params := s3.ListObjectsV2Input{
+		Bucket: &s3p.bucketName,
+		Prefix: &prefix,
+	}
+	err := s3p.client.ListObjectsV2Pages(&params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("ERROR: listing %s (%s)", s3p.location(prefix), err.Error())
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s3p *S3Proxy) location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s3p.bucketName, key)
+}
+
+func (s3p *S3Proxy) head(key string) (*s3.HeadObjectOutput, error) {
+	return s3p.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3p.bucketName,
+		Key:    &key,
+	})
+}
+
 //
 // end of file
 //
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HealthChecker - our interface
+type HealthChecker interface {
+
+	// note a successful poll of the inbound queue
+	PollSucceeded()
+
+	// note that the specified worker is making progress
+	WorkerProgress(int)
+
+	// note that we are shutting down
+	ShuttingDown()
+
+	// are we ready to do work, if not, why not
+	Ready() (bool, map[string]string)
+}
+
+// ServiceHealth our singleton health checker
+var ServiceHealth HealthChecker
+
+// this is our actual implementation
+type healthCheckerImpl struct {
+	cacheMaxAge time.Duration // the cache must have been reloaded within this time to be ready
+	window      time.Duration // polling and worker progress must have happened within this time to be ready
+
+	lastPoll     time.Time         // the time of the last successful poll
+	workers      map[int]time.Time // the time each worker last made progress
+	shuttingDown bool              // are we shutting down
+
+	mu sync.RWMutex // protect the above
+}
+
+// NewHealthChecker - the factory
+func NewHealthChecker(config *ServiceConfig) {
+
+	impl := &healthCheckerImpl{}
+	impl.cacheMaxAge = time.Duration(config.CacheAge*config.ReadyCacheAgeFactor) * time.Second
+	impl.window = time.Duration(config.ReadyWindow) * time.Second
+	impl.workers = make(map[int]time.Time)
+
+	// assign to our global singleton
+	ServiceHealth = impl
+}
+
+func (hc *healthCheckerImpl) PollSucceeded() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.lastPoll = time.Now()
+}
+
+func (hc *healthCheckerImpl) WorkerProgress(id int) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.workers[id] = time.Now()
+}
+
+func (hc *healthCheckerImpl) ShuttingDown() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.shuttingDown = true
+}
+
+func (hc *healthCheckerImpl) Ready() (bool, map[string]string) {
+
+	ready := true
+	checks := make(map[string]string)
+
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	if hc.shuttingDown == true {
+		ready = false
+		checks["service"] = "shutting down"
+	} else {
+		checks["service"] = "ok"
+	}
+
+	// the Tracksys ID cache must have been loaded recently
+	var loaded time.Time
+	if TracksysIdCache != nil {
+		loaded = TracksysIdCache.LastLoaded()
+	}
+	if loaded.IsZero() == true {
+		ready = false
+		checks["cache"] = "not loaded"
+	} else if TracksysIdCache.Suspended() == true {
+		ready = false
+		checks["cache"] = fmt.Sprintf("expired, last loaded %s, queue consumption paused", loaded.Format(time.RFC3339))
+	} else if time.Since(loaded) > hc.cacheMaxAge {
+		ready = false
+		checks["cache"] = fmt.Sprintf("stale, last loaded %s", loaded.Format(time.RFC3339))
+	} else {
+		checks["cache"] = "ok"
+	}
+
+	// the inbound queue must have been polled recently
+	if hc.lastPoll.IsZero() == true {
+		ready = false
+		checks["queue"] = "not polled"
+	} else if time.Since(hc.lastPoll) > hc.window {
+		ready = false
+		checks["queue"] = fmt.Sprintf("no successful poll since %s", hc.lastPoll.Format(time.RFC3339))
+	} else {
+		checks["queue"] = "ok"
+	}
+
+	// and the workers must be making progress
+	checks["workers"] = "ok"
+	if len(hc.workers) == 0 {
+		ready = false
+		checks["workers"] = "not started"
+	}
+	for id, progress := range hc.workers {
+		if time.Since(progress) > hc.window {
+			ready = false
+			checks["workers"] = fmt.Sprintf("worker %d no progress since %s", id, progress.Format(time.RFC3339))
+			break
+		}
+	}
+
+	return ready, checks
+}
+
+//
+// end of file
+//
@@ -7,7 +7,7 @@ import (
 
 func (cl *cacheLoaderImpl) protocolGetKnownIds(url string) (*TracksysKnown, error) {
 
-	payload, err := httpGet(url, cl.httpClient)
+	payload, err := httpGet(url, endpointKnownIds, cl.httpClient)
 	if err != nil {
 		return nil, err
 	}
@@ -25,7 +25,7 @@ func (cl *cacheLoaderImpl) protocolGetKnownIds(url string) (*TracksysKnown, erro
 
 func (cl *cacheLoaderImpl) protocolGetSirsiDetails(url string) (*TracksysSirsiItem, error) {
 
-	payload, err := httpGet(url, cl.httpClient)
+	payload, err := httpGet(url, endpointDetails, cl.httpClient)
 	if err != nil {
 		return nil, err
 	}
@@ -41,7 +41,7 @@ func (cl *cacheLoaderImpl) protocolGetSirsiDetails(url string) (*TracksysSirsiIt
 
 func (cl *cacheLoaderImpl) protocolGetImageDetails(url string) (*TracksysPart, error) {
 
-	payload, err := httpGet(url, cl.httpClient)
+	payload, err := httpGet(url, endpointDetails, cl.httpClient)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +57,7 @@ func (cl *cacheLoaderImpl) protocolGetImageDetails(url string) (*TracksysPart, e
 
 func (cl *cacheLoaderImpl) protocolGetPidDetails(url string) (*TracksysPidItem, error) {
 
-	payload, err := httpGet(url, cl.httpClient)
+	payload, err := httpGet(url, endpointPidDetails, cl.httpClient)
 	if err != nil {
 		return nil, err
 	}
@@ -3,15 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/http"
 	"strings"
 
-	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"github.com/uvalib/virgo4-tracksys-enrich/solrdoc"
 )
 
-// a SOLR limitation
-//var maxSolrFieldSize = 32765
-
 //
 // Much of this code is based on the existing SOLRMark plugin to handle tracksys decoration. See more details:
 // https://github.com/uvalib/utilities/blob/master/bib/bin/solrmarc3/index_java/src/DlMixin.java
@@ -20,281 +16,151 @@ import (
 
 // this is our actual implementation
 type tracksysEnrichStepImpl struct {
-	RightsEndpoint string       // the Rights URL
-	httpClient     *http.Client // our http client connection
+	rights            RightsClient     // the rights policy client
+	rightsAggregation string           // how part policies are combined
+	mapping           *FieldMapping    // the Tracksys to Solr field mapping
+	rules             *CollectionRules // the collection specific rules
+	pdfStatus         PdfStatusClient  // the PDF status client
 }
 
 // NewTracksysEnrichStep - the factory
-func NewTracksysEnrichStep(config *ServiceConfig) PipelineStep {
+func NewTracksysEnrichStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
 
 	// mock implementation here if necessary
 
+	err := options.Validate("mapping")
+	if err != nil {
+		return nil, err
+	}
+
 	impl := &tracksysEnrichStepImpl{}
+	impl.mapping, err = LoadFieldMapping(options.Get("mapping", defaultFieldMappingFile))
+	if err != nil {
+		return nil, err
+	}
+	impl.rules, err = NewCollectionRules(config)
+	if err != nil {
+		return nil, err
+	}
 
-	impl.httpClient = newHttpClient(2, config.ServiceTimeout)
-	impl.RightsEndpoint = config.RightsEndpoint
+	impl.pdfStatus = NewPdfStatusClient(config)
+	impl.rights = NewRightsClient(config)
+	impl.rightsAggregation = config.RightsAggregation
 
-	return impl
+	return impl, nil
 }
 
 func (si *tracksysEnrichStepImpl) Name() string {
-	return "Tracksys enrich"
+	return stepNameTracksysEnrich
 }
 
-func (si *tracksysEnrichStepImpl) Process(message *awssqs.Message, data interface{}) (bool, interface{}, error) {
+func (si *tracksysEnrichStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextTracksys}
+}
 
-	tracksysData, ok := data.(TracksysSirsiItem)
-	if ok == false {
-		log.Printf("ERROR: failed to type assert into known payload")
-		return false, data, ErrorTypeAssertion
-	}
+func (si *tracksysEnrichStepImpl) Provides() []ContextItem {
+	return []ContextItem{ContextRights, ContextPdfStatus}
+}
+
+func (si *tracksysEnrichStepImpl) Process(ctx *EnrichContext) (bool, error) {
 
-	err := si.applyEnrichment(tracksysData, message)
+	err := si.applyEnrichment(ctx)
 	if err != nil {
-		return false, data, err
+		return false, err
 	}
 
-	return true, data, nil
+	return true, nil
 }
 
-func (si *tracksysEnrichStepImpl) applyEnrichment(tracksysDetails TracksysSirsiItem, message *awssqs.Message) error {
-
-	// extract the information from the tracksys structure
-	format_facets, _ := si.extractFormatFacets(tracksysDetails)
-	feature_facets, _ := si.extractFeatureFacets(tracksysDetails)
-	source_facets, _ := si.extractSourceFacets(tracksysDetails)
-	marc_display_facets := []string{"true"}
-
-	additional_collection_facets, _ := si.extractAdditionalCollectionFacets(tracksysDetails)
-	alternate_ids, _ := si.extractAlternateIds(tracksysDetails)
-	individual_call_number_display, _ := si.extractCallNumbers(tracksysDetails)
-	//iiif_presentation_metadata_display, err := si.extractIIIFManifest( tracksysDetails )
-	//if err != nil {
-	//   return err
-	//}
-	thumbnail_url_display, _ := si.extractThumbnailUrlDisplay(tracksysDetails)
-	rights_wrapper_url_display, _ := si.extractRightsWrapperUrlDisplay(tracksysDetails)
-	rights_wrapper_display, _ := si.extractRightsWrapperDisplay(tracksysDetails)
-	pdf_url_display, _ := si.extractPdfRootUrlDisplay(tracksysDetails)
-	pdf_download_url_display, err := si.extractPdfDownloadUrlDisplay(tracksysDetails)
-	if err != nil {
-		return err
-	}
-	policy_facets, err := si.extractPolicyFacets(tracksysDetails)
+func (si *tracksysEnrichStepImpl) applyEnrichment(ctx *EnrichContext) error {
+
+	tracksysDetails := *ctx.Tracksys
+
+	// the attributes that require additional service calls
+	pdf_download_url_display, pdf_feature_facets := si.extractPdfDownloadUrlDisplay(tracksysDetails, ctx.PdfStatus)
+	policy_facets, err := si.extractPolicyFacets(ctx, tracksysDetails)
 	if err != nil {
 		return err
 	}
-	despined_barcodes_display, _ := si.extractDespinedBarcodesDisplay(tracksysDetails)
-
-	// build our additional tag data
-	var additionalTags strings.Builder
-
-	additionalTags.WriteString(ConstructFieldTagSet("format_f_stored", XmlEncodeValues(format_facets)))
-	additionalTags.WriteString(ConstructFieldTagSet("feature_f_stored", XmlEncodeValues(feature_facets)))
-	additionalTags.WriteString(ConstructFieldTagSet("source_f_stored", XmlEncodeValues(source_facets)))
-
-	additionalTags.WriteString(ConstructFieldTagSet("marc_display_f_stored", XmlEncodeValues(marc_display_facets)))
-	additionalTags.WriteString(ConstructFieldTagSet("digital_collection_f_stored", XmlEncodeValues(additional_collection_facets)))
-	//additionalTags.WriteString(ConstructFieldTagSet("alternate_id_f_stored", XmlEncodeValues(alternate_ids)))
-	additionalTags.WriteString(ConstructFieldTagSet("individual_call_number_a", XmlEncodeValues(individual_call_number_display)))
-	additionalTags.WriteString(ConstructFieldTagSet("thumbnail_url_a", XmlEncodeValues(thumbnail_url_display)))
-	additionalTags.WriteString(ConstructFieldTagSet("rights_wrapper_url_a", XmlEncodeValues(rights_wrapper_url_display)))
-	additionalTags.WriteString(ConstructFieldTagSet("rights_wrapper_a", XmlEncodeValues(rights_wrapper_display)))
-	additionalTags.WriteString(ConstructFieldTagSet("pdf_url_a", XmlEncodeValues(pdf_url_display)))
-	additionalTags.WriteString(ConstructFieldTagSet("policy_f_stored", XmlEncodeValues(policy_facets)))
-	additionalTags.WriteString(ConstructFieldTagSet("despined_barcodes_a", XmlEncodeValues(despined_barcodes_display)))
-
-	// if we have a PDF download link (which means one is available)
-	if len(pdf_download_url_display) != 0 {
-		additionalTags.WriteString(ConstructFieldTagSet("pdf_download_url_e_stored", XmlEncodeValues(pdf_download_url_display)))
-	}
 
-	additionalTags.WriteString(ConstructFieldTagSet("alternate_id_str_stored", XmlEncodeValues(alternate_ids)))
+	computed := map[string][]string{
+		"policy":         policy_facets,
+		"pdfDownloadUrl": pdf_download_url_display,
+		"pdfFeature":     pdf_feature_facets,
+	}
 
-	// a special case
-	//buf := ConstructFieldTagSet( "iiif_presentation_metadata_a", XmlEncodeValues( iiif_presentation_metadata_display ) )
-	//sz := len( buf )
-	//if sz > maxSolrFieldSize {
-	//   log.Printf("WARNING: iiif_presentation_metadata_a field exceeds maximum size, ignoring. size %d", sz )
-	//} else {
-	//   additionalTags.WriteString(buf)
-	//}
+	// build our additional field data from the field mapping and any collection specific rules
+	additional := solrdoc.NewDocument()
+	fields := si.mapping.Apply(&tracksysDetails, computed)
+	additional.AppendFields(si.rules.ApplyFields(fields, &tracksysDetails, computed)...)
 
-	log.Printf("DEBUG: enrich %s with [%s]", tracksysDetails.SirsiId, additionalTags.String())
+	log.Printf("DEBUG: enrich %s with [%s]", tracksysDetails.SirsiId, additional.FieldsString())
 
 	// tack it on the end of the document
-	docEndTag := "</doc>"
-	additionalTags.WriteString(docEndTag)
-	current := string(message.Payload)
-	current = strings.Replace(current, docEndTag, additionalTags.String(), 1)
-	message.Payload = []byte(current)
+	ctx.AddFields(additional.Fields...)
 	return nil
 }
 
-func (si *tracksysEnrichStepImpl) extractFormatFacets(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := []string{"Online"}
-	return res, nil
-}
-
-func (si *tracksysEnrichStepImpl) extractFeatureFacets(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 5)
-	res = append(res, "availability")
-	res = append(res, "iiif")
-	res = append(res, "dl_metadata")
-	res = append(res, "rights_wrapper")
-	if len(tracksysDetails.PdfServiceRoot) != 0 {
-		res = append(res, "pdf_service")
-	}
-	return res, nil
-}
-
-func (si *tracksysEnrichStepImpl) extractSourceFacets(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := []string{"UVA Library Digital Repository"}
-	return res, nil
-}
+// the download url of each part with a ready PDF and the PDF feature for the item
+func (si *tracksysEnrichStepImpl) extractPdfDownloadUrlDisplay(tracksysDetails TracksysSirsiItem, pdfStatus map[string]string) ([]string, []string) {
 
-func (si *tracksysEnrichStepImpl) extractAdditionalCollectionFacets(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 1)
-	if len(tracksysDetails.Collection) != 0 {
-		res = append(res, tracksysDetails.Collection)
-	}
-	return res, nil
-}
-
-func (si *tracksysEnrichStepImpl) extractAlternateIds(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 10)
+	// the item PDF root applies to every part unless the part has its own
+	roots := make([]string, 0, len(tracksysDetails.Items))
+	pids := make([]string, 0, len(tracksysDetails.Items))
 	for _, i := range tracksysDetails.Items {
-		if len(i.Pid) != 0 {
-			res = append(res, i.Pid)
+		root := tracksysDetails.PdfServiceRoot
+		if len(root) == 0 {
+			root = i.PdfServiceRoot
 		}
-	}
-	return res, nil
-}
-
-func (si *tracksysEnrichStepImpl) extractCallNumbers(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 10)
-	for _, i := range tracksysDetails.Items {
-		if len(i.CallNumber) != 0 {
-			res = append(res, i.CallNumber)
+		if len(root) != 0 && len(i.Pid) != 0 {
+			roots = append(roots, root)
+			pids = append(pids, i.Pid)
 		}
 	}
-	return res, nil
-}
-
-//func (e *tracksysEnrichStepImpl) extractIIIFManifest(tracksysDetails TracksysSirsiItem) ([]string, error) {
-//
-//	urls := make([]string, 0, 10)
-//	for _, i := range tracksysDetails.Items {
-//		if len(i.BackendIIIFManifestUrl) != 0 {
-//			urls = append(urls, i.BackendIIIFManifestUrl)
-//		}
-//	}
-//
-//	res := make([]string, 0, 10)
-//	for _, i := range urls {
-//		body, err := httpGet(i, e.httpClient)
-//		if err == nil {
-//			res = append(res, string(body))
-//		} else {
-//			log.Printf("ERROR: endpoint %s returns %s", i, err)
-//			return nil, err
-//		}
-//	}
-//
-//	return res, nil
-//}
 
-func (si *tracksysEnrichStepImpl) extractThumbnailUrlDisplay(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 10)
-	for _, i := range tracksysDetails.Items {
-		if len(i.ThumbnailUrl) != 0 {
-			res = append(res, i.ThumbnailUrl)
-		}
+	// no PDF service for this item
+	if len(pids) == 0 {
+		return []string{}, []string{}
 	}
-	return res, nil
-}
 
-func (si *tracksysEnrichStepImpl) extractRightsWrapperUrlDisplay(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 10)
-	for _, i := range tracksysDetails.Items {
-		if len(i.RightsWrapperUrl) != 0 {
-			res = append(res, i.RightsWrapperUrl)
+	res := make([]string, 0, len(pids))
+	status := si.pdfStatus.Status(roots, pids)
+	for ix, pid := range pids {
+		pdfStatus[pid] = status[ix]
+		// if we have a PDF available
+		if status[ix] == pdfStatusReady {
+			res = append(res, fmt.Sprintf("%s/%s/download", roots[ix], pid))
 		}
 	}
-	return res, nil
+	return res, []string{pdfFeature(status)}
 }
 
-func (si *tracksysEnrichStepImpl) extractRightsWrapperDisplay(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 10)
+func (si *tracksysEnrichStepImpl) extractPolicyFacets(ctx *EnrichContext, tracksysDetails TracksysSirsiItem) ([]string, error) {
+
+	pids := make([]string, 0, len(tracksysDetails.Items))
 	for _, i := range tracksysDetails.Items {
-		if len(i.RightsWrapperText) != 0 {
-			res = append(res, i.RightsWrapperText)
+		if len(i.Pid) != 0 {
+			pids = append(pids, i.Pid)
 		}
 	}
-	return res, nil
-}
 
-func (si *tracksysEnrichStepImpl) extractPdfRootUrlDisplay(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 1)
-	if len(tracksysDetails.PdfServiceRoot) != 0 {
-		res = append(res, tracksysDetails.PdfServiceRoot)
+	// only the first part policy is used so there is no point getting the others
+	if si.rightsAggregation == rightsAggregationFirst && len(pids) > 1 {
+		pids = pids[:1]
 	}
-	return res, nil
-}
 
-func (si *tracksysEnrichStepImpl) extractPdfDownloadUrlDisplay(tracksysDetails TracksysSirsiItem) ([]string, error) {
-	res := make([]string, 0, 1)
-	// we have a PDF root defined and the item contains just one part
-	if len(tracksysDetails.PdfServiceRoot) != 0 && len(tracksysDetails.Items) == 1 {
-		pid := tracksysDetails.Items[0].Pid
-		url := fmt.Sprintf("%s/%s/status", tracksysDetails.PdfServiceRoot, pid)
-		body, err := httpGet(url, si.httpClient)
-		if err == nil {
-			// if we have a PDF available
-			if string(body) == "READY" {
-				downloadUrl := fmt.Sprintf("%s/%s/download", tracksysDetails.PdfServiceRoot, pid)
-				res = append(res, downloadUrl)
-			}
-		} //else {
-		// we will assume any error means a PDF is not available
-		//}
+	policies, fallback, err := si.rights.Lookup(pids)
+	if err != nil {
+		return nil, err
 	}
-	return res, nil
-}
-
-func (si *tracksysEnrichStepImpl) extractPolicyFacets(tracksysDetails TracksysSirsiItem) ([]string, error) {
-
-	res := make([]string, 0, 1)
-	for _, i := range tracksysDetails.Items {
-		if len(i.Pid) != 0 {
-			url := fmt.Sprintf("%s/%s", si.RightsEndpoint, i.Pid)
-			body, err := httpGet(url, si.httpClient)
-			if err == nil {
-				if string(body) != "public" {
-					res = append(res, string(body))
-				}
-				break
-			} else {
-				log.Printf("ERROR: endpoint %s returns %s", url, err)
-				return nil, err
-			}
-		}
+	if len(fallback) != 0 {
+		ctx.Warning(fmt.Sprintf("rights service unavailable, using fallback policy for %s", strings.Join(fallback, ", ")))
 	}
 
-	return res, nil
-}
-
-func (si *tracksysEnrichStepImpl) extractDespinedBarcodesDisplay(tracksysDetails TracksysSirsiItem) ([]string, error) {
-
-	res := make([]string, 0, 10)
-	if tracksysDetails.Collection == "Gannon Collection" {
-		for _, i := range tracksysDetails.Items {
-			if len(i.Barcode) != 0 {
-				res = append(res, i.Barcode)
-			}
-		}
+	for pid, policy := range policies {
+		ctx.Rights[pid] = policy
 	}
-	return res, nil
+	return aggregateRights(pids, policies, si.rightsAggregation), nil
 }
 
 //
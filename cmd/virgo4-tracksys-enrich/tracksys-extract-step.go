@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
 )
 
@@ -18,37 +17,50 @@ type tracksysExtractStepImpl struct {
 }
 
 // NewTracksysExtractStep - the factory
-func NewTracksysExtractStep(config *ServiceConfig) PipelineStep {
+func NewTracksysExtractStep(config *ServiceConfig, store ContentCacheStore, options StepOptions) (PipelineStep, error) {
 
 	// mock implementation here if necessary
 
+	err := options.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	impl := &tracksysExtractStepImpl{}
-	return impl
+	return impl, nil
 }
 
 func (si *tracksysExtractStepImpl) Name() string {
-	return "Tracksys extract"
+	return stepNameTracksysExtract
+}
+
+func (si *tracksysExtractStepImpl) Requires() []ContextItem {
+	return []ContextItem{ContextRecordId}
+}
+
+func (si *tracksysExtractStepImpl) Provides() []ContextItem {
+	return []ContextItem{ContextTracksys}
 }
 
-func (si *tracksysExtractStepImpl) Process(message *awssqs.Message, _ interface{}) (bool, interface{}, error) {
+func (si *tracksysExtractStepImpl) Process(ctx *EnrichContext) (bool, error) {
 
 	// extract the ID else we cannot do anything
-	id, foundId := message.GetAttribute(awssqs.AttributeKeyRecordId)
-	if foundId == true {
+	id := ctx.RecordId
+	if len(id) != 0 {
 
 		var err error
 		var lookupTrackSys = false
 
 		// see if we have the attribute telling us to ignore the cache
-		_, foundId = message.GetAttribute(ignoreCacheAttributeName)
-		if foundId == true {
+		_, ignoreCache := ctx.Message.GetAttribute(ignoreCacheAttributeName)
+		if ignoreCache == true {
 			log.Printf("INFO: id %s marked to IGNORE tracksys cache, getting details", id)
 			lookupTrackSys = true
 		} else {
 			// look the item up in the cache to see if tracksys knows about it
 			lookupTrackSys, err = TracksysIdCache.Contains(id)
 			if err != nil {
-				return false, nil, err
+				return false, err
 			}
 			if lookupTrackSys == true {
 				log.Printf("INFO: located id %s in tracksys cache, getting details", id)
@@ -60,19 +72,20 @@ func (si *tracksysExtractStepImpl) Process(message *awssqs.Message, _ interface{
 			// actually do the lookup work
 			trackSysDetails, err := TracksysIdCache.Lookup(id)
 			if err != nil {
-				return false, nil, err
+				return false, err
 			}
 			// we found the item in tracksys
-			return true, *trackSysDetails, nil
+			ctx.Tracksys = trackSysDetails
+			return true, nil
 		} else {
 			//log.Printf("DEBUG: %s is not in the cache, no further processing", id )
 			// item is not in tracksys, no further processing required
-			return false, nil, nil
+			return false, nil
 		}
 	}
 
 	log.Printf("ERROR: no identifier attribute located for document, no tracksys lookup possible")
-	return false, nil, errorNoIdentifier
+	return false, errorNoIdentifier
 }
 
 //
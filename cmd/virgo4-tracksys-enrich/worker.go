@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
@@ -12,10 +13,36 @@ var waitTimeout = 5 * time.Second
 
 var emptyOpList = make([]awssqs.OpStatus, 0)
 
-func worker(id int, config *ServiceConfig, aws awssqs.AWS_SQS, inbound <-chan awssqs.Message, inQueue awssqs.QueueHandle, outQueue awssqs.QueueHandle) {
+// MessageStats - message accounting shared by the poller and the workers
+type MessageStats struct {
+	received  uint64 // messages received from the inbound queue
+	processed uint64 // messages that have been through processesInboundBlock
+}
+
+// AddReceived - note messages received from the inbound queue
+func (ms *MessageStats) AddReceived(count int) {
+	atomic.AddUint64(&ms.received, uint64(count))
+}
+
+// AddProcessed - note messages processed by a worker
+func (ms *MessageStats) AddProcessed(count int) {
+	atomic.AddUint64(&ms.processed, uint64(count))
+}
+
+// Received - the number of messages received
+func (ms *MessageStats) Received() uint64 {
+	return atomic.LoadUint64(&ms.received)
+}
+
+// Processed - the number of messages processed
+func (ms *MessageStats) Processed() uint64 {
+	return atomic.LoadUint64(&ms.processed)
+}
+
+func worker(id int, config *ServiceConfig, aws awssqs.AWS_SQS, enrichPipeline Pipeline, inbound <-chan awssqs.Message, inQueue awssqs.QueueHandle, outQueue awssqs.QueueHandle, deadLetter *DeadLetter, stats *MessageStats) {
 
-	// a new enricher pipeline
-	enrichPipeline := NewEnrichPipeline(config)
+	// and our metrics
+	metrics := NewWorkerMetrics(id)
 
 	// keep a list of the messages queued so we can delete them once they are sent to SOLR
 	queued := make([]awssqs.Message, 0, awssqs.MAX_SQS_BLOCK_COUNT)
@@ -28,31 +55,53 @@ func worker(id int, config *ServiceConfig, aws awssqs.AWS_SQS, inbound <-chan aw
 	for {
 
 		arrived := false
+		more := true
 
 		// process a message or wait...
 		select {
-		case message = <-inbound:
-			arrived = true
+		case message, more = <-inbound:
+			arrived = more
 
 		case <-time.After(waitTimeout):
 		}
 
+		// we are not wedged
+		ServiceHealth.WorkerProgress(id)
+
+		// the inbound channel is closed and drained, flush anything pending and exit
+		if more == false {
+			if blocksize != 0 {
+				log.Printf("INFO: worker %d: flushing %d pending message(s) before exit", id, blocksize)
+				_, err := processesInboundBlock(enrichPipeline, aws, queued, inQueue, outQueue, deadLetter, metrics)
+				if err != nil {
+					if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+						fatalIfError(err)
+					}
+				}
+				stats.AddProcessed(len(queued))
+			}
+			log.Printf("INFO: worker %d: terminating", id)
+			return
+		}
+
 		// we have an inbound message to process
 		if arrived == true {
 
 			// update counts
 			blocksize++
 			count++
+			metrics.Received.Inc()
 
 			// add it to the queued list
 			queued = append(queued, message)
 			if blocksize == awssqs.MAX_SQS_BLOCK_COUNT {
-				_, err := processesInboundBlock(enrichPipeline, aws, queued, inQueue, outQueue)
+				_, err := processesInboundBlock(enrichPipeline, aws, queued, inQueue, outQueue, deadLetter, metrics)
 				if err != nil {
 					if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
 						fatalIfError(err)
 					}
 				}
+				stats.AddProcessed(len(queued))
 
 				// reset the counts
 				blocksize = 0
@@ -68,12 +117,13 @@ func worker(id int, config *ServiceConfig, aws awssqs.AWS_SQS, inbound <-chan aw
 
 			// we timed out, probably best to send anything pending
 			if blocksize != 0 {
-				_, err := processesInboundBlock(enrichPipeline, aws, queued, inQueue, outQueue)
+				_, err := processesInboundBlock(enrichPipeline, aws, queued, inQueue, outQueue, deadLetter, metrics)
 				if err != nil {
 					if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
 						fatalIfError(err)
 					}
 				}
+				stats.AddProcessed(len(queued))
 
 				duration := time.Since(start)
 				log.Printf("INFO: worker %d: processed %d messages (%0.2f tps) (flushing)", id, count, float64(count)/duration.Seconds())
@@ -90,17 +140,24 @@ func worker(id int, config *ServiceConfig, aws awssqs.AWS_SQS, inbound <-chan aw
 	}
 }
 
-func processesInboundBlock(enrichPipeline Pipeline, aws awssqs.AWS_SQS, inboundMessages []awssqs.Message, inQueue awssqs.QueueHandle, outQueue awssqs.QueueHandle) ([]awssqs.OpStatus, error) {
+func processesInboundBlock(enrichPipeline Pipeline, aws awssqs.AWS_SQS, inboundMessages []awssqs.Message, inQueue awssqs.QueueHandle, outQueue awssqs.QueueHandle, deadLetter *DeadLetter, metrics *WorkerMetrics) ([]awssqs.OpStatus, error) {
 
 	// keep a list of the ones that succeed/fail
 	finalStatus := make([]awssqs.OpStatus, len(inboundMessages))
 	processStatus := make([]awssqs.OpStatus, len(inboundMessages))
 
+	// the messages that failed enrichment and are going to the dead letter queue (and their inbound index)
+	deadLetterMessages := make([]awssqs.Message, 0)
+	deadLetterIndex := make([]int, 0)
+
 	//log.Printf("%d records to process", len(inboundMessages))
 
 	// enrich as much as possible, in the event of an error, just press on
 	for ix := range inboundMessages {
-		_, err := enrichPipeline.Process(&inboundMessages[ix])
+
+		// the pipeline replaces the payload as it goes so keep the original in case we need to dead letter it
+		originalPayload := inboundMessages[ix].Payload
+		step, err := enrichPipeline.Process(&inboundMessages[ix])
 
 		if err != nil {
 			id, found := inboundMessages[ix].GetAttribute(awssqs.AttributeKeyRecordId)
@@ -109,10 +166,18 @@ func processesInboundBlock(enrichPipeline Pipeline, aws awssqs.AWS_SQS, inboundM
 			} else {
 				log.Printf("WARNING: enrich pipeline failed for id %s (%s)", id, err)
 			}
-		}
 
-		// for now, we still want to process records that failed enrichment/rewriting
-		processStatus[ix] = true
+			if deadLetter.Publish() == true {
+				deadLetterMessages = append(deadLetterMessages,
+					deadLetter.MakeMessage(inboundMessages[ix].Attribs, originalPayload, step, enrichPipeline.StepName(step), err))
+				deadLetterIndex = append(deadLetterIndex, ix)
+			}
+
+			// depending on policy, we may still want to process records that failed enrichment/rewriting
+			processStatus[ix] = awssqs.OpStatus(deadLetter.Forward())
+		} else {
+			processStatus[ix] = true
+		}
 	}
 
 	//
@@ -140,6 +205,8 @@ func processesInboundBlock(enrichPipeline Pipeline, aws awssqs.AWS_SQS, inboundM
 		}
 	}
 
+	metrics.Put.Add(float64(countSuccessful(putStatus)))
+
 	// check the operation results
 	for ix, op := range putStatus {
 		if op == false {
@@ -161,8 +228,32 @@ func processesInboundBlock(enrichPipeline Pipeline, aws awssqs.AWS_SQS, inboundM
 		}
 	}
 
+	// publish any failures to the dead letter queue, these are complete once they are published (and forwarded
+	// if the policy requires it)
+	if len(deadLetterMessages) != 0 {
+		log.Printf("INFO: publishing %d message(s) to the dead letter queue", len(deadLetterMessages))
+		dlStatus, dlErr := aws.BatchMessagePut(deadLetter.Queue(), deadLetterMessages)
+		if dlErr != nil {
+			if dlErr != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+				return emptyOpList, dlErr
+			}
+		}
+
+		metrics.DeadLettered.Add(float64(countSuccessful(dlStatus)))
+
+		for dx, op := range dlStatus {
+			ix := deadLetterIndex[dx]
+			if op == false {
+				log.Printf("WARNING: message %d failed to send to dead letter queue", ix)
+				finalStatus[ix] = false
+			} else if deadLetter.Forward() == false {
+				finalStatus[ix] = true
+			}
+		}
+	}
+
 	// we only delete the ones that completed successfully
-	deleteMessages := make([]awssqs.Message, 0, len(outboundMessages))
+	deleteMessages := make([]awssqs.Message, 0, len(inboundMessages))
 
 	for ix, op := range finalStatus {
 		if op == true {
@@ -180,6 +271,8 @@ func processesInboundBlock(enrichPipeline Pipeline, aws awssqs.AWS_SQS, inboundM
 		}
 	}
 
+	metrics.Deleted.Add(float64(countSuccessful(delStatus)))
+
 	// we will ignore delete failures for now because they will be tried again when the message is next processed
 	for ix, op := range delStatus {
 		if op == false {
@@ -1,11 +1,27 @@
 module github.com/uvalib/virgo4-tracksys-enrich
 
-go 1.14
+go 1.20
 
 require (
 	github.com/aws/aws-sdk-go v1.55.5
-	github.com/kr/pretty v0.1.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/prometheus/client_golang v1.20.5
+	github.com/prometheus/client_model v0.6.1
 	github.com/uvalib/virgo4-sqs-sdk/awssqs v0.0.0-20240403123433-2102b063dbb8
-	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	golang.org/x/sync v0.7.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	github.com/uvalib/uva-aws-s3-sdk/uva-s3 v0.0.0-20240202155653-277e11cf83e3 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
@@ -1,6 +1,7 @@
 # run application
 
-./bin/virgo4-tracksys-enrich
+# exec so we receive signals directly (for graceful shutdown)
+exec ./bin/virgo4-tracksys-enrich
 
 #
 # end of file
@@ -0,0 +1,420 @@
+// Package solrdoc provides a simple document model for Solr XML update messages (<add><doc>...</doc></add>)
+// so fields can be inspected and manipulated without resorting to string replacement. Field order, field
+// and document attributes (e.g. boost, update), multi-valued fields and multiple (or nested) documents are
+// preserved. Insignificant whitespace between elements and comments are not, although a payload that has
+// not been changed is serialized exactly as received.
+package solrdoc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNoDocument - the payload does not contain a <doc> element
+var ErrNoDocument = errors.New("no document located in payload")
+
+// Field - a single field value, multi-valued fields are represented by several fields with the same name
+type Field struct {
+	Name  string     // the field name
+	Value string     // the (unescaped) field value
+	Attrs []xml.Attr // any attributes other than the name (e.g. boost, update)
+}
+
+// Document - a Solr document
+type Document struct {
+	Attrs    []xml.Attr  // the document attributes
+	Fields   []Field     // the fields in document order
+	Children []*Document // any nested child documents
+}
+
+// AddDoc - a Solr add request containing one or more documents
+type AddDoc struct {
+	Attrs []xml.Attr  // the <add> attributes (e.g. commitWithin, overwrite)
+	Docs  []*Document // the documents
+
+	declaration string // the xml declaration, if present
+	wrapped     bool   // were the documents wrapped in an <add> element
+	original    []byte // the payload as received
+	parsed      []byte // the payload as serialized immediately after parsing
+}
+
+// the xml namespace is predeclared
+var xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// the state of a parse, the decoder resolves attribute prefixes to namespace urls so we remember the
+// prefix declared for each url in order to write the attributes as received
+type parser struct {
+	dec      *xml.Decoder
+	prefixes map[string]string
+}
+
+// NewDocument - create an empty document
+func NewDocument() *Document {
+	return &Document{}
+}
+
+// Parse - parse the supplied payload
+func Parse(buf []byte) (*AddDoc, error) {
+
+	add := &AddDoc{}
+	p := &parser{dec: xml.NewDecoder(bytes.NewReader(buf)), prefixes: map[string]string{xmlNamespace: "xml"}}
+
+	for {
+		tok, err := p.dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				add.declaration = string(t.Inst)
+			}
+
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "add":
+				if add.wrapped == true || len(add.Docs) != 0 {
+					return nil, fmt.Errorf("unexpected <add> element")
+				}
+				add.wrapped = true
+				add.Attrs = p.attrs(t.Attr)
+
+			case "doc":
+				doc, err := p.parseDocument(t)
+				if err != nil {
+					return nil, err
+				}
+				add.Docs = append(add.Docs, doc)
+
+			default:
+				return nil, fmt.Errorf("unexpected <%s> element", t.Name.Local)
+			}
+		}
+	}
+
+	if len(add.Docs) == 0 {
+		return nil, ErrNoDocument
+	}
+
+	add.original = append([]byte(nil), buf...)
+	add.parsed = add.serialize()
+	return add, nil
+}
+
+// Doc - the first (and usually only) document
+func (add *AddDoc) Doc() *Document {
+	return add.Docs[0]
+}
+
+// Bytes - serialize the add request, the payload as received if nothing has changed
+func (add *AddDoc) Bytes() []byte {
+
+	res := add.serialize()
+	if add.original != nil && bytes.Equal(res, add.parsed) == true {
+		return append([]byte(nil), add.original...)
+	}
+	return res
+}
+
+func (add *AddDoc) serialize() []byte {
+
+	var buf bytes.Buffer
+	if len(add.declaration) != 0 {
+		buf.WriteString("<?xml ")
+		buf.WriteString(add.declaration)
+		buf.WriteString("?>")
+	}
+
+	if add.wrapped == true {
+		writeStartElement(&buf, "add", add.Attrs)
+	}
+	for _, d := range add.Docs {
+		d.write(&buf)
+	}
+	if add.wrapped == true {
+		buf.WriteString("</add>")
+	}
+
+	return buf.Bytes()
+}
+
+// Get - all the values of the named field
+func (d *Document) Get(name string) []string {
+
+	values := make([]string, 0)
+	for _, f := range d.Fields {
+		if f.Name == name {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// First - the first value of the named field
+func (d *Document) First(name string) (string, bool) {
+
+	for _, f := range d.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Has - does the document contain the named field
+func (d *Document) Has(name string) bool {
+	_, found := d.First(name)
+	return found
+}
+
+// Append - append values for the named field to the end of the document
+func (d *Document) Append(name string, values ...string) {
+	for _, v := range values {
+		d.Fields = append(d.Fields, Field{Name: name, Value: v})
+	}
+}
+
+// AppendFields - append the fields to the end of the document
+func (d *Document) AppendFields(fields ...Field) {
+	d.Fields = append(d.Fields, fields...)
+}
+
+// Remove - remove all values of the named field, returns the number removed
+func (d *Document) Remove(name string) int {
+
+	kept := d.Fields[:0]
+	removed := 0
+	for _, f := range d.Fields {
+		if f.Name == name {
+			removed++
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	d.Fields = kept
+	return removed
+}
+
+// Set - replace all values of the named field, the new values take the place of the first existing
+// value or are appended if the field does not exist
+func (d *Document) Set(name string, values ...string) {
+
+	position := -1
+	for ix, f := range d.Fields {
+		if f.Name == name {
+			position = ix
+			break
+		}
+	}
+
+	if position == -1 {
+		d.Append(name, values...)
+		return
+	}
+
+	fields := make([]Field, 0, len(d.Fields)+len(values))
+	for ix, f := range d.Fields {
+		if ix == position {
+			for _, v := range values {
+				fields = append(fields, Field{Name: name, Value: v})
+			}
+		}
+		if f.Name != name {
+			fields = append(fields, f)
+		}
+	}
+	d.Fields = fields
+}
+
+// String - the serialized document
+func (d *Document) String() string {
+	var buf bytes.Buffer
+	d.write(&buf)
+	return buf.String()
+}
+
+// FieldsString - the serialized fields only (useful for logging)
+func (d *Document) FieldsString() string {
+	var buf bytes.Buffer
+	for _, f := range d.Fields {
+		f.write(&buf)
+	}
+	return buf.String()
+}
+
+//
+// private implementation methods
+//
+
+func (p *parser) parseDocument(start xml.StartElement) (*Document, error) {
+
+	doc := &Document{Attrs: p.attrs(start.Attr)}
+	for {
+		tok, err := p.dec.Token()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "field":
+				field, err := p.parseField(t)
+				if err != nil {
+					return nil, err
+				}
+				doc.Fields = append(doc.Fields, field)
+
+			case "doc":
+				child, err := p.parseDocument(t)
+				if err != nil {
+					return nil, err
+				}
+				doc.Children = append(doc.Children, child)
+
+			default:
+				return nil, fmt.Errorf("unexpected <%s> element in document", t.Name.Local)
+			}
+
+		case xml.EndElement:
+			// the decoder ensures this is our end element
+			return doc, nil
+		}
+	}
+}
+
+func (p *parser) parseField(start xml.StartElement) (Field, error) {
+
+	field := Field{}
+	for _, a := range p.attrs(start.Attr) {
+		if a.Name.Space == "" && a.Name.Local == "name" {
+			field.Name = a.Value
+		} else {
+			field.Attrs = append(field.Attrs, a)
+		}
+	}
+
+	if len(field.Name) == 0 {
+		return field, fmt.Errorf("field without a name attribute")
+	}
+
+	var value strings.Builder
+	for {
+		tok, err := p.dec.Token()
+		if err != nil {
+			return field, unexpectedEOF(err)
+		}
+
+		switch t := tok.(type) {
+		case xml.CharData:
+			value.Write(t)
+
+		case xml.StartElement:
+			return field, fmt.Errorf("unexpected <%s> element in field %s", t.Name.Local, field.Name)
+
+		case xml.EndElement:
+			field.Value = value.String()
+			return field, nil
+		}
+	}
+}
+
+func (d *Document) write(buf *bytes.Buffer) {
+
+	writeStartElement(buf, "doc", d.Attrs)
+	for _, f := range d.Fields {
+		f.write(buf)
+	}
+	for _, c := range d.Children {
+		c.write(buf)
+	}
+	buf.WriteString("</doc>")
+}
+
+func (f Field) write(buf *bytes.Buffer) {
+
+	attrs := make([]xml.Attr, 0, len(f.Attrs)+1)
+	attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "name"}, Value: f.Name})
+	attrs = append(attrs, f.Attrs...)
+	writeStartElement(buf, "field", attrs)
+	buf.WriteString(escapeText(f.Value))
+	buf.WriteString("</field>")
+}
+
+func writeStartElement(buf *bytes.Buffer, name string, attrs []xml.Attr) {
+
+	buf.WriteString("<")
+	buf.WriteString(name)
+	for _, a := range attrs {
+		buf.WriteString(" ")
+		if len(a.Name.Space) != 0 {
+			buf.WriteString(a.Name.Space)
+			buf.WriteString(":")
+		}
+		buf.WriteString(a.Name.Local)
+		buf.WriteString("=\"")
+		buf.WriteString(escapeAttr(a.Value))
+		buf.WriteString("\"")
+	}
+	buf.WriteString(">")
+}
+
+// we escape only what is necessary so multi-line values remain readable
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;",
+	"\r", "&#xD;", "\n", "&#xA;", "\t", "&#x9;")
+
+func escapeText(value string) string {
+	return textEscaper.Replace(value)
+}
+
+func escapeAttr(value string) string {
+	return attrEscaper.Replace(value)
+}
+
+// copy the attributes, restoring the declared prefix of any namespaced attribute
+func (p *parser) attrs(attrs []xml.Attr) []xml.Attr {
+
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	// note any namespace declarations first, they apply to the element they are declared on
+	for _, a := range attrs {
+		if a.Name.Space == "xmlns" {
+			p.prefixes[a.Value] = a.Name.Local
+		}
+	}
+
+	newAttrs := make([]xml.Attr, len(attrs))
+	copy(newAttrs, attrs)
+	for ix, a := range newAttrs {
+		if len(a.Name.Space) == 0 || a.Name.Space == "xmlns" {
+			continue
+		}
+		// an undeclared prefix is left as is by the decoder
+		if prefix, found := p.prefixes[a.Name.Space]; found == true {
+			newAttrs[ix].Name.Space = prefix
+		}
+	}
+	return newAttrs
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//
+// end of file
+//
@@ -0,0 +1,180 @@
+package solrdoc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseValues(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		payload string
+		field   string
+		values  []string
+	}{
+		{"plain", `<add><doc><field name="id">u1</field></doc></add>`, "id", []string{"u1"}},
+		{"escaped quotes", `<doc><field name="title">A &quot;quoted&quot; title</field></doc>`, "title", []string{`A "quoted" title`}},
+		{"ampersand", `<doc><field name="title">Smith &amp; Jones &lt;eds&gt;</field></doc>`, "title", []string{"Smith & Jones <eds>"}},
+		{"cdata", `<doc><field name="title"><![CDATA[<b>bold</b> & "raw"]]></field></doc>`, "title", []string{`<b>bold</b> & "raw"`}},
+		{"multi-line", "<doc><field name=\"note\">line one\n  line two\n</field></doc>", "note", []string{"line one\n  line two\n"}},
+		{"multi-valued", `<doc><field name="s">a</field><field name="t">x</field><field name="s">b</field></doc>`, "s", []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, err := Parse([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			values := add.Doc().Get(tt.field)
+			if reflect.DeepEqual(values, tt.values) == false {
+				t.Errorf("expected %q, got %q", tt.values, values)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"no document", `<add></add>`},
+		{"unnamed field", `<doc><field>x</field></doc>`},
+		{"unexpected element", `<doc><foo>x</foo></doc>`},
+		{"truncated", `<add><doc><field name="id">u1</field>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.payload))
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestUntouchedIsByteIdentical(t *testing.T) {
+
+	payloads := []string{
+		`<add><doc><field name="id">u1</field></doc></add>`,
+		"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<add>\n  <doc boost=\"2.0\">\n    <field name=\"id\">u1</field>\n  </doc>\n</add>\n",
+		`<doc><field name="title">A &quot;quoted&quot; &amp; <![CDATA[raw]]></field><!-- comment --></doc>`,
+	}
+
+	for _, p := range payloads {
+		add, err := Parse([]byte(p))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(add.Bytes()) != p {
+			t.Errorf("expected the payload unchanged, got %s", add.Bytes())
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected string
+	}{
+		{
+			"escaping",
+			`<add><doc><field name="id">u1</field><field name="title">A &quot;quoted&quot; &amp; <![CDATA[<raw>]]></field></doc></add>`,
+			`<add><doc><field name="id">u1</field><field name="title">A "quoted" &amp; &lt;raw&gt;</field><field name="x">y</field></doc></add>`,
+		},
+		{
+			"multi-line",
+			"<doc><field name=\"id\">u1</field><field name=\"note\">one\r\ntwo\n</field></doc>",
+			"<doc><field name=\"id\">u1</field><field name=\"note\">one\ntwo\n</field><field name=\"x\">y</field></doc>",
+		},
+		{
+			"attributes",
+			`<add commitWithin="1000" overwrite="true"><doc boost="2.0"><field name="id">u1</field><field name="title" boost="1.5" update="set">t &quot;1&quot;</field></doc></add>`,
+			`<add commitWithin="1000" overwrite="true"><doc boost="2.0"><field name="id">u1</field><field name="title" boost="1.5" update="set">t "1"</field><field name="x">y</field></doc></add>`,
+		},
+		{
+			"namespaced attributes",
+			`<add xmlns:ex="http://example.com/ns"><doc ex:source="a" xml:lang="en"><field name="id">u1</field></doc></add>`,
+			`<add xmlns:ex="http://example.com/ns"><doc ex:source="a" xml:lang="en"><field name="id">u1</field><field name="x">y</field></doc></add>`,
+		},
+		{
+			"nested",
+			`<doc><field name="id">u1</field><doc><field name="id">u1-1</field></doc></doc>`,
+			`<doc><field name="id">u1</field><field name="x">y</field><doc><field name="id">u1-1</field></doc></doc>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, err := Parse([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			add.Doc().Append("x", "y")
+			if string(add.Bytes()) != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, add.Bytes())
+			}
+
+			// and the result parses to the same document
+			again, err := Parse(add.Bytes())
+			if err != nil {
+				t.Fatalf("unexpected error reparsing: %s", err)
+			}
+			if reflect.DeepEqual(again.Doc().Fields, add.Doc().Fields) == false {
+				t.Errorf("reparsed fields differ: %v and %v", again.Doc().Fields, add.Doc().Fields)
+			}
+		})
+	}
+}
+
+func TestMultipleDocuments(t *testing.T) {
+
+	payload := `<add><doc><field name="id">u1</field></doc><doc><field name="id">u2</field></doc></add>`
+	add, err := Parse([]byte(payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(add.Docs) != 2 {
+		t.Fatalf("expected 2 documents, got %d", len(add.Docs))
+	}
+
+	add.Docs[1].Set("id", "u3")
+	expected := `<add><doc><field name="id">u1</field></doc><doc><field name="id">u3</field></doc></add>`
+	if string(add.Bytes()) != expected {
+		t.Errorf("expected %s, got %s", expected, add.Bytes())
+	}
+}
+
+func TestFieldOperations(t *testing.T) {
+
+	add, err := Parse([]byte(`<doc><field name="a">1</field><field name="b">2</field><field name="a">3</field><field name="c">4</field></doc>`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	doc := add.Doc()
+
+	doc.Set("a", "x", "y")
+	if got := doc.FieldsString(); got != `<field name="a">x</field><field name="a">y</field><field name="b">2</field><field name="c">4</field>` {
+		t.Errorf("unexpected fields after set: %s", got)
+	}
+	if doc.Remove("a") != 2 || doc.Has("a") == true {
+		t.Errorf("expected a to be removed")
+	}
+	if first, _ := doc.First("c"); first != "4" {
+		t.Errorf("expected 4, got %s", first)
+	}
+	if strings.Contains(string(add.Bytes()), `name="a"`) == true {
+		t.Errorf("removed field serialized: %s", add.Bytes())
+	}
+}
+
+//
+// end of file
+//